@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/validator"
+)
+
+// The listUsersHandler() lists users, filtered by part of their email address, whether they are
+// activated or suspended, and when they were created.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email         string
+		Activated     *bool
+		Suspended     *bool
+		CreatedAfter  *time.Time
+		CreatedBefore *time.Time
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	if qs.Has("activated") {
+		activated := app.readBool(qs, "activated", false, v)
+		input.Activated = &activated
+	}
+	if qs.Has("suspended") {
+		suspended := app.readBool(qs, "suspended", false, v)
+		input.Suspended = &suspended
+	}
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Email, input.Activated, input.Suspended, input.CreatedAfter, input.CreatedBefore, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAll(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(user.ID, int32(user.Version)))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions, "roles": roles}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserHandler() lets an administrator change a user's name and email address, activate
+// them, and suspend them or lift their suspension. Suspending a user also signs them out
+// everywhere and suspends the service accounts they own. In the jwt authentication mode, the
+// JWTs they have been issued keep working until they expire, unless -jwt-check-revocation is set.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkIfMatch(w, r, etag(user.ID, int32(user.Version))) {
+		return
+	}
+
+	before := *user
+
+	var input struct {
+		Name      *string `json:"name"`
+		Email     *string `json:"email"`
+		Activated *bool   `json:"activated"`
+		Suspended *bool   `json:"suspended"`
+		Locale    *string `json:"locale"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Email != nil {
+		user.Email = *input.Email
+	}
+	if input.Activated != nil {
+		user.Activated = *input.Activated
+	}
+	if input.Locale != nil {
+		user.Locale = matchLocale(*input.Locale)
+	}
+
+	suspending := false
+	if input.Suspended != nil {
+		v.Check(user.ID != app.contextGetUser(r).ID, "suspended", "own-account")
+
+		switch {
+		case *input.Suspended && !user.IsSuspended():
+			now := time.Now()
+			user.SuspendedAt = &now
+			suspending = true
+		case !*input.Suspended:
+			user.SuspendedAt = nil
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Suspending a user also signs them out and suspends their service accounts, all of which
+	// has to happen together with the audit for the user to be suspended at all.
+	err = app.models.WithTx(func(tx *sql.Tx) error {
+		err := app.models.Users.UpdateTx(tx, user)
+		if err != nil {
+			return err
+		}
+
+		if suspending {
+			err = app.models.Tokens.DeleteAllSessionsForUserTx(tx, user.ID)
+			if err != nil {
+				return err
+			}
+
+			err = app.models.Tokens.DeleteAllForUserTx(tx, data.ScopeMFA, user.ID)
+			if err != nil {
+				return err
+			}
+
+			// Otherwise the user could carry on through the API keys of their service accounts.
+			ids, err := app.models.Users.SuspendServiceAccountsTx(tx, user.ID)
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				err = app.auditTx(tx, r, data.AuditUserUpdate, "user", id, map[string]any{"suspended": false}, map[string]any{"suspended": true})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return app.auditTx(tx, r, data.AuditUserUpdate, "user", user.ID, before, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "duplicate-email")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(user.ID, int32(user.Version)))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("user", "delete-own-account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Users.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditUserDelete, "user", user.ID, user, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The grantUserPermissionsHandler() grants permission codes to a user directly, on top of those
+// which come with their roles.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Permissions) > 0, "permissions", "min-permissions")
+	v.Check(validator.Unique(input.Permissions), "permissions", "duplicate-values")
+
+	if !app.checkKnownPermissions(w, r, v, input.Permissions) {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPermissionGrant, "user", user.ID, nil, map[string]any{"permissions": input.Permissions})
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeUserPermissionHandler() takes away a permission code which was granted to the user
+// directly. The response lists the permissions which the user still has, which include the
+// revoked one if it also comes with one of their roles.
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	v := validator.New()
+
+	if !app.checkKnownPermissions(w, r, v, []string{code}) {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPermissionRevoke, "user", user.ID, map[string]any{"permissions": []string{code}}, nil)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper loads the user whose ID is in the URL, for the admin endpoints. If
+// there isn't one, or an error occurs, it sends an error response and returns false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/i18n"
+	"github.com/navarrovmn/internal/validator"
+	"net/http"
+	"time"
+)
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+
+	v := validator.New()
+	data.ValidateAPIKey(v, key)
+
+	ok := app.checkGrantablePermissions(w, r, v, key.Permissions)
+	if !ok {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key, err = app.models.APIKeys.New(key.UserID, key.Name, key.Permissions, key.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAPIKeyName):
+			v.AddError("name", "duplicate-api-key")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditAPIKeyCreate, "api_key", key.ID, nil, auditAPIKey(key))
+
+	// This is the only time that the key is sent to the client.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Delete(user.ID, int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditAPIKeyDelete, "api_key", int64(id), nil, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createServiceAccountHandler() creates a service account owned by the user, along with
+// its first API key. Service accounts have a random email address and password which nobody
+// knows, so they can only authenticate with API keys. They can use their key to manage their
+// own keys through /v1/users/me/api-keys.
+func (app *application) createServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	owner := app.contextGetUser(r)
+
+	if owner.ServiceAccount {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	random := make([]byte, 40)
+	_, err = rand.Read(random)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := &data.User{
+		Name:           input.Name,
+		Email:          hex.EncodeToString(random[:8]) + "@service-accounts.invalid",
+		Activated:      true,
+		ServiceAccount: true,
+		OwnerID:        &owner.ID,
+		Locale:         i18n.Default,
+	}
+
+	err = user.Password.Set(hex.EncodeToString(random[8:]))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateUser(v, user)
+	v.Check(len(input.Permissions) > 0, "permissions", "min-permissions")
+	v.Check(validator.Unique(input.Permissions), "permissions", "duplicate-values")
+
+	ok := app.checkGrantablePermissions(w, r, v, input.Permissions)
+	if !ok {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The service account, its permissions and its key are created together, so that a
+	// failure can't leave a service account without permissions or a key.
+	var key *data.APIKey
+
+	err = app.models.WithTx(func(tx *sql.Tx) error {
+		err := app.models.Users.InsertTx(tx, user)
+		if err != nil {
+			return err
+		}
+
+		err = app.models.Permissions.AddForUserTx(tx, user.ID, input.Permissions...)
+		if err != nil {
+			return err
+		}
+
+		key, err = app.models.APIKeys.NewTx(tx, user.ID, "default", input.Permissions, nil)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditUserCreate, "user", user.ID, nil, user)
+	app.audit(r, data.AuditAPIKeyCreate, "api_key", key.ID, nil, auditAPIKey(key))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"service_account": user, "api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	owner := app.contextGetUser(r)
+
+	users, err := app.models.Users.GetAllServiceAccounts(owner.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"service_accounts": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	owner := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Users.DeleteServiceAccount(owner.ID, int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditUserDelete, "user", int64(id), nil, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "service account successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkGrantablePermissions() helper checks that the request may pass on the permissions to
+// an API key or service account. Requests can only pass on permissions which their own
+// credentials have, so an API key can't be used to create a key with more permissions than it
+// has itself. It returns false if an error response had to be sent.
+func (app *application) checkGrantablePermissions(w http.ResponseWriter, r *http.Request, v *validator.Validator, codes []string) bool {
+	granted, ok := app.contextGetPermissions(r)
+	if !ok {
+		var err error
+		granted, err = app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	for _, code := range codes {
+		if !granted.Include(code) {
+			v.AddError("permissions", "permissions-not-held")
+			break
+		}
+	}
+
+	return true
+}
+
+// auditAPIKey returns the fields of an API key which are recorded in the audit log, leaving out
+// the key itself.
+func auditAPIKey(key *data.APIKey) map[string]any {
+	return map[string]any{"user_id": key.UserID, "name": key.Name, "permissions": key.Permissions, "expiry": key.Expiry}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// The audit() helper records an action taken by the authenticated user in the audit log. The
+// before and after values are the target record's state, either of which can be nil, and the
+// changes between them are stored as the event's diff. The action has already happened, so a
+// failure to record it is logged rather than sent to the client.
+func (app *application) audit(r *http.Request, action, targetType string, targetID int64, before, after any) {
+	app.auditAs(r, app.contextGetUser(r).ID, action, targetType, targetID, before, after)
+}
+
+// The auditAs() helper is like audit(), for requests where the actor isn't the authenticated
+// user, such as signing in or activating an account. An actorID of 0 records no actor.
+func (app *application) auditAs(r *http.Request, actorID int64, action, targetType string, targetID int64, before, after any) {
+	event, err := app.newAuditEvent(r, actorID, action, targetType, targetID, before, after)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	err = app.models.Audit.Insert(event, app.config.audit.hashChain)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The auditTx() helper is like audit(), but records the event as part of the transaction which
+// takes the action. Unlike audit(), it returns any error, so that the action is rolled back
+// rather than left unrecorded.
+func (app *application) auditTx(tx *sql.Tx, r *http.Request, action, targetType string, targetID int64, before, after any) error {
+	event, err := app.newAuditEvent(r, app.contextGetUser(r).ID, action, targetType, targetID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Audit.InsertTx(tx, event, app.config.audit.hashChain)
+}
+
+func (app *application) newAuditEvent(r *http.Request, actorID int64, action, targetType string, targetID int64, before, after any) (*data.AuditEvent, error) {
+	event := &data.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		IP:         realip.FromRequest(r),
+		RequestID:  app.contextGetRequestID(r),
+	}
+
+	if actorID > 0 {
+		event.ActorID = &actorID
+	}
+	if targetID > 0 {
+		event.TargetID = &targetID
+	}
+
+	diff, err := data.AuditDiff(before, after)
+	if err != nil {
+		return nil, err
+	}
+	event.Diff = diff
+
+	return event, nil
+}
+
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ActorID    int
+		Action     string
+		TargetType string
+		TargetID   int
+		Since      *time.Time
+		Until      *time.Time
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.ActorID = app.readInt(qs, "actor", 0, v)
+	input.Action = app.readString(qs, "action", "")
+	input.TargetType = app.readString(qs, "target_type", "")
+	input.TargetID = app.readInt(qs, "target", 0, v)
+	input.Since = app.readTime(qs, "since", v)
+	input.Until = app.readTime(qs, "until", v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "-id"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(int64(input.ActorID), input.Action, input.TargetType, int64(input.TargetID), input.Since, input.Until, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The verifyAuditLogHandler() checks the audit log's hash chain. Events which were recorded
+// while hash chaining was disabled aren't part of the chain, and aren't checked.
+func (app *application) verifyAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	checked, brokenAt, err := app.models.Audit.Verify()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"valid": brokenAt == 0, "events_checked": checked}
+	if brokenAt != 0 {
+		env["broken_at"] = brokenAt
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
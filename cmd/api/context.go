@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/jwt"
 	"net/http"
 )
 
@@ -14,6 +15,21 @@ type contextKey string
 // in the request.
 const userContextKey = contextKey("user")
 
+// The sessionIDContextKey is used for getting and setting the ID of the session whose
+// authentication token the request was made with.
+const sessionIDContextKey = contextKey("session_id")
+
+// The claimsContextKey is used for getting and setting the claims of a JWT which the request
+// was authenticated with.
+const claimsContextKey = contextKey("claims")
+
+// The permissionsContextKey is used for getting and setting permissions which came with the
+// credentials that the request was authenticated with, such as a JWT or an API key.
+const permissionsContextKey = contextKey("permissions")
+
+// The requestIDContextKey is used for getting and setting the unique ID of the request.
+const requestIDContextKey = contextKey("request_id")
+
 // The contextSetUser() method returns a new copy of the request with the provided User struct added to the context.
 // Note that we use our userContextKey constant as the key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -32,3 +48,57 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetRequestID() method returns a new copy of the request with the provided request ID added to the context.
+func (app *application) contextSetRequestID(r *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() retrieves the request ID from the request. Unlike contextGetUser(), this
+// doesn't panic if there isn't one, because errors can be logged and reported before the requestID
+// middleware runs. In that case it returns an empty string.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// The contextSetSessionID() method returns a new copy of the request with the ID of the current session added to the context.
+func (app *application) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetSessionID() retrieves the ID of the current session from the request. It returns
+// zero for anonymous requests, which never match a session.
+func (app *application) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionIDContextKey).(int64)
+	return id
+}
+
+// The contextSetClaims() method returns a new copy of the request with the provided JWT claims added to the context.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClaims() retrieves the JWT claims from the request. It returns nil when the request
+// wasn't authenticated with a JWT.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the provided permissions added to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() retrieves the permissions which came with the request's credentials.
+// The second return value is false when there aren't any, in which case the user's own
+// permissions apply.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
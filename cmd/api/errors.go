@@ -1,85 +1,230 @@
 package main
 
-import "net/http"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navarrovmn/internal/i18n"
+	"github.com/navarrovmn/internal/validator"
+)
+
+// The base URI for the type member of problem details responses. Each kind of failure is
+// identified by a stable path segment appended to it, such as "edit-conflict".
+const problemTypeBaseURI = "https://greenlight.victornavarro.net/problems/"
+
+// A problem holds an error response in the RFC 7807 application/problem+json format. The
+// errors extension member carries the field errors from a failed validation.
+type problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
 
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = r.URL.RequestURI()
+		requestID = app.contextGetRequestID(r)
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestID)
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelope{"error": message}
+// The errorResponse() method sends an error to the client. By default this is a JSON object
+// with the message under an "error" key. If the client accepts application/problem+json, or
+// the server is configured to always use it, a problem details object is sent instead, with
+// a type URI built from problemType. Messages are in the locale of the request, which is sent
+// in the Content-Language header.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, problemType string, message any) {
+	w.Header().Set("Content-Language", app.requestLocale(r))
+	w.Header().Add("Vary", "Accept-Language")
+
+	if !app.useProblemDetails(r) {
+		env := envelope{"error": message}
+
+		err := app.writeJSON(w, status, env, nil)
+		if err != nil {
+			app.logError(r, err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	p := problem{
+		Type:   problemTypeBaseURI + problemType,
+		Title:  http.StatusText(status),
+		Status: status,
+	}
+
+	switch message := message.(type) {
+	case map[string]string:
+		p.Detail = app.translate(r, "failed-validation")
+		p.Errors = message
+	default:
+		p.Detail = fmt.Sprint(message)
+	}
+
+	if requestID := app.contextGetRequestID(r); requestID != "" {
+		p.Instance = "urn:uuid:" + requestID
+	}
 
-	err := app.writeJSON(w, status, env, nil)
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/problem+json")
+
+	err := app.writeJSON(w, status, p, headers)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+// The useProblemDetails() method reports whether error responses to this request should use
+// the application/problem+json format.
+func (app *application) useProblemDetails(r *http.Request) bool {
+	if app.config.errors.format == "problem" {
+		return true
+	}
+
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(mediaRange, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "application/problem+json") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A requestError is a problem with a request which the client is told about, such as a body
+// which isn't valid JSON. Like a validation error, it is identified by a message code, so that
+// it can be sent in the client's language.
+type requestError struct {
+	message validator.Message
+}
+
+func newRequestError(code string, args ...any) error {
+	return &requestError{message: validator.Message{Code: code, Args: args}}
+}
+
+// Error returns the message in the default locale, for logging.
+func (e *requestError) Error() string {
+	return i18n.Translate(i18n.Default, e.message.Code, e.message.Args...)
+}
+
+// The badRequestResponse() method sends the message of a request error in the client's
+// language. Other errors aren't meant for the client, so a general message is sent instead.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	message := app.translate(r, "bad-request")
+
+	var requestErr *requestError
+	if errors.As(err, &requestErr) {
+		message = app.translate(r, requestErr.message.Code, requestErr.message.Args...)
+	}
+
+	app.errorResponse(w, r, http.StatusBadRequest, "bad-request", message)
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
-	message := "the server encountered an error and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	message := app.translate(r, "server-error")
+	app.errorResponse(w, r, http.StatusInternalServerError, "server-error", message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
-	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	message := app.translate(r, "not-found")
+	app.errorResponse(w, r, http.StatusNotFound, "not-found", message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := "the requested method is not allowed"
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	message := app.translate(r, "method-not-allowed")
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method-not-allowed", message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request, supported ...string) {
+	message := app.translate(r, "not-acceptable", strings.Join(supported, ", "))
+	app.errorResponse(w, r, http.StatusNotAcceptable, "not-acceptable", message)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported ...string) {
+	message := app.translate(r, "unsupported-media-type", strings.Join(supported, ", "))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, "unsupported-media-type", message)
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]validator.Message) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed-validation", app.translateErrors(r, errors))
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
-	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	message := app.translate(r, "edit-conflict")
+	app.errorResponse(w, r, http.StatusConflict, "edit-conflict", message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.translate(r, "precondition-failed")
+	app.errorResponse(w, r, http.StatusPreconditionFailed, "precondition-failed", message)
+}
+
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.translate(r, "precondition-required")
+	app.errorResponse(w, r, http.StatusPreconditionRequired, "precondition-required", message)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
-	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	message := app.translate(r, "rate-limited")
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate-limited", message)
+}
+
+// The loginLockedResponse() method is sent when there have been too many failed attempts to
+// sign in. The Retry-After header tells the client how many seconds to wait.
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+
+	message := app.translate(r, "login-locked")
+	app.errorResponse(w, r, http.StatusTooManyRequests, "login-locked", message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
-	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	message := app.translate(r, "invalid-credentials")
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid-credentials", message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	// Set this header to help inform the client we expect them to authenticate user a bearer token.
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
-	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	message := app.translate(r, "invalid-authentication-token")
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid-authentication-token", message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
-	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	message := app.translate(r, "authentication-required")
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication-required", message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	message := app.translate(r, "inactive-account")
+	app.errorResponse(w, r, http.StatusForbidden, "inactive-account", message)
+}
+
+func (app *application) suspendedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.translate(r, "account-suspended")
+	app.errorResponse(w, r, http.StatusForbidden, "account-suspended", message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	message := app.translate(r, "not-permitted")
+	app.errorResponse(w, r, http.StatusForbidden, "not-permitted", message)
+}
+
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.translate(r, "mfa-required")
+	app.errorResponse(w, r, http.StatusForbidden, "mfa-required", message)
 }
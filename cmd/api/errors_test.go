@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBadRequestResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		err            error
+		want           string
+		wantLanguage   string
+	}{
+		{
+			name: "english",
+			err:  newRequestError("empty-body"),
+			want: "body must not be empty", wantLanguage: "en",
+		},
+		{
+			name:           "translated",
+			acceptLanguage: "pt-BR",
+			err:            newRequestError("empty-body"),
+			want:           "o corpo não pode estar vazio", wantLanguage: "pt-BR",
+		},
+		{
+			name:           "translated with args",
+			acceptLanguage: "es-MX, en;q=0.5",
+			err:            newRequestError("unknown-json-field", "rating"),
+			want:           `el cuerpo contiene la clave desconocida "rating"`, wantLanguage: "es",
+		},
+		{
+			name:           "other errors aren't sent",
+			acceptLanguage: "es",
+			err:            errors.New("pq: connection refused"),
+			want:           "no se pudo entender la solicitud", wantLanguage: "es",
+		},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			w := httptest.NewRecorder()
+
+			app.badRequestResponse(w, r, tt.err)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d; want %d", w.Code, http.StatusBadRequest)
+			}
+
+			if got := w.Header().Get("Content-Language"); got != tt.wantLanguage {
+				t.Errorf("Content-Language = %q; want %q", got, tt.wantLanguage)
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Error != tt.want {
+				t.Errorf("error = %q; want %q", body.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestErrorMessage(t *testing.T) {
+	err := newRequestError("invalid-parameter", "id")
+
+	if got, want := err.Error(), "invalid id parameter"; got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navarrovmn/internal/data"
+)
+
+// The exportMoviesHandler() streams every movie matching the title and genres filters as a
+// JSON array, NDJSON or CSV, depending on the Accept header. The movies are written as they
+// are read from the database, rather than being collected first like listMoviesHandler()
+// does. Once the first movie has been written an error can't be reported to the client, so
+// it is logged and the response is cut short.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+
+	offers := []string{"application/json", "application/x-ndjson", "text/csv"}
+
+	contentType := app.negotiateContentType(r, offers...)
+	if contentType == "" {
+		app.notAcceptableResponse(w, r, offers...)
+		return
+	}
+
+	var write func(*data.Movie) error
+	var finish func() error
+
+	switch contentType {
+	case "application/x-ndjson":
+		enc := json.NewEncoder(w)
+		write = func(movie *data.Movie) error {
+			return enc.Encode(movie)
+		}
+		finish = func() error { return nil }
+
+	case "text/csv":
+		// The header row is written even if no movies match. The writer is buffered, so it
+		// isn't sent until the first movies are flushed or the export finishes.
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		write = func(movie *data.Movie) error {
+			return cw.Write([]string{
+				strconv.FormatInt(movie.ID, 10),
+				movie.Title,
+				strconv.Itoa(int(movie.Year)),
+				strconv.Itoa(int(movie.Runtime)) + " mins",
+				strings.Join(movie.Genres, ","),
+				strconv.Itoa(int(movie.Version)),
+			})
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+	default:
+		first := true
+		write = func(movie *data.Movie) error {
+			js, err := json.Marshal(movie)
+			if err != nil {
+				return err
+			}
+
+			separator := ",\n"
+			if first {
+				separator = "[\n"
+				first = false
+			}
+
+			_, err = w.Write(append([]byte(separator), js...))
+			return err
+		}
+		finish = func() error {
+			closing := "\n]\n"
+			if first {
+				closing = "[]\n"
+			}
+
+			_, err := w.Write([]byte(closing))
+			return err
+		}
+	}
+
+	// The status line is sent implicitly by the first write, so an error which happens
+	// before any movie has been written can still be reported as a normal error response.
+	w.Header().Set("Content-Type", contentType)
+
+	// Keep pushing the write deadline back while the export is making progress, instead of
+	// removing it altogether, so a client which stops reading is still disconnected.
+	rc := http.NewResponseController(w)
+	exported := 0
+
+	err := app.models.Movies.Export(r.Context(), title, genres, func(movie *data.Movie) error {
+		if exported%500 == 0 {
+			if err := rc.SetWriteDeadline(time.Now().Add(30 * time.Second)); err != nil {
+				return err
+			}
+		}
+
+		exported++
+		return write(movie)
+	})
+	if err != nil {
+		if exported == 0 {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.logError(r, err)
+		return
+	}
+
+	err = finish()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/navarrovmn/internal/data"
 	"github.com/navarrovmn/internal/validator"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -39,29 +41,45 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 		syntaxError           *json.SyntaxError
 		unmarshallTypeError   *json.UnmarshalTypeError
 		invalidUnmarshalError *json.InvalidUnmarshalError
+		maxBytesError         *http.MaxBytesError
 	)
 
+	// The errors are returned as request errors, which carry a message code rather than text,
+	// so that badRequestResponse() can send them in the client's language.
 	switch {
 	// Use the errors.As() function to check whether the error has the type *json.SyntaxError
-	// If so, return an plain-english message which includes location of the problem
+	// If so, return an error which includes location of the problem
 	case errors.As(err, &syntaxError):
-		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		return newRequestError("badly-formed-json-at", syntaxError.Offset)
 	// In some circumstances Decode() can return an io.ErrUnexpectedEOF error
 	// for syntax errors in JSON. We check for this using errors.Is()
 	case errors.Is(err, io.ErrUnexpectedEOF):
-		return errors.New("body contains badly-formed JSON")
+		return newRequestError("badly-formed-json")
 	// Likewise, catch any *json.UnmarshalTypeError errors. These occur when the JSON value is the wrong type
 	// for the target destination. If the error relates to a specific field, then we include that in our error message
 	case errors.As(err, &unmarshallTypeError):
 		if unmarshallTypeError.Field != "" {
-			return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshallTypeError.Field)
+			return newRequestError("incorrect-json-type-for", unmarshallTypeError.Field)
 		}
 
-		return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshallTypeError.Offset)
+		return newRequestError("incorrect-json-type", unmarshallTypeError.Offset)
 	// An io.EOF error will be returned by Decode() if the request body is empty.
-	// We check this with errors.Is() and return a plain-english error message.
 	case errors.Is(err, io.EOF):
-		return errors.New("body must not be empty")
+		return newRequestError("empty-body")
+	// Because of DisallowUnknownFields(), Decode() returns an error of the form
+	// json: unknown field "<name>" for a field which dst doesn't have. There isn't a
+	// distinct error type for it, so the name is taken from the message.
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, unquoteErr := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		if unquoteErr != nil {
+			return newRequestError("badly-formed-json")
+		}
+		return newRequestError("unknown-json-field", field)
+	// http.MaxBytesReader() makes reads fail once the body is larger than the limit.
+	case errors.As(err, &maxBytesError):
+		return newRequestError("body-too-large", maxBytesError.Limit)
+	case errors.Is(err, data.ErrInvalidRuntimeFormat):
+		return newRequestError("invalid-runtime-json")
 	// A json.InvalidUnmarshalError error will be returned if we pass something
 	// that is not a non-nil pointer to Decode(). We catch this and panic rather
 	// than returning an error to our handler. At the end of this chapter we'll talk about
@@ -69,7 +87,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	// in this specific situation.
 	case errors.As(err, &invalidUnmarshalError):
 		panic(err)
-	// For anything else, return the error message as-is.
+	// For anything else, return the error as-is.
 	default:
 		return err
 	}
@@ -83,12 +101,15 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data any, h
 
 	js = append(js, '\n')
 
+	// Set the default Content-Type before adding the headers, so that it can be
+	// overridden by the caller.
+	w.Header().Set("Content-Type", "application/json")
+
 	// At this point, let's add the headers
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	w.Write(js)
 
@@ -100,12 +121,37 @@ func (app *application) readIDParam(r *http.Request) (int, error) {
 
 	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
 	if err != nil {
-		return 0, errors.New("invalid id parameter")
+		return 0, newRequestError("invalid-parameter", "id")
 	}
 
 	return int(id), nil
 }
 
+// The readNamedIDParam() helper reads an ID from the named URL parameter, for routes which
+// have more than one ID in their path.
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
+	if err != nil || id < 1 {
+		return 0, newRequestError("invalid-parameter", name)
+	}
+
+	return id, nil
+}
+
+// The readVersionParam() helper reads the version number of a revision from the URL.
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, newRequestError("invalid-parameter", "version")
+	}
+
+	return int32(version), nil
+}
+
 // The readString() helper returns a string value from the query string, or the provided default value.
 func (app *application) readString(qs url.Values, key, defaultValue string) string {
 	s := qs.Get(key)
@@ -138,13 +184,119 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddError(key, "integer")
 		return defaultValue
 	}
 
 	return i
 }
 
+// The readBool() helper reads a string value from the query string and converts it to a boolean before returning.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "boolean")
+		return defaultValue
+	}
+
+	return b
+}
+
+// The readTime() helper reads an RFC 3339 timestamp from the query string. It returns nil if
+// the key is missing or the value can't be parsed.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "rfc3339")
+		return nil
+	}
+
+	return &t
+}
+
+// The negotiateContentType() helper returns the offered media type which the request's Accept
+// header gives the highest quality value, or an empty string if it accepts none of them. Each
+// offer takes its quality value from the most specific media range which matches it, so
+// "text/csv;q=0, */*" accepts anything but CSV, and a quality value of 0 means the offer isn't
+// acceptable at all. A missing Accept header accepts every offer. When offers have the same
+// quality value, the one listed first is returned.
+func (app *application) negotiateContentType(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		mediaType string
+		quality   float64
+	}
+
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				quality = parsed
+			}
+		}
+
+		ranges = append(ranges, mediaRange{mediaType: mediaType, quality: quality})
+	}
+
+	best, bestQuality := "", 0.0
+
+	for _, offer := range offers {
+		// 3 for an exact match, 2 for type/* and 1 for */*.
+		specificity, quality := 0, 0.0
+
+		for _, mr := range ranges {
+			var s int
+			switch {
+			case mr.mediaType == offer:
+				s = 3
+			case strings.HasSuffix(mr.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mr.mediaType, "*")):
+				s = 2
+			case mr.mediaType == "*/*":
+				s = 1
+			}
+
+			if s > specificity {
+				specificity, quality = s, mr.quality
+			}
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+
+	return best
+}
+
 // The background() helper accepts an arbitrary function as parameter.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
@@ -160,3 +312,91 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The etag() helper returns a strong entity tag for a versioned resource. The version
+// number is incremented on every update, so the ID and version together identify a
+// specific representation of the resource.
+func etag(id int64, version int32) string {
+	return fmt.Sprintf(`"%d-%d"`, id, version)
+}
+
+// The movieETag() helper returns the entity tag for a movie. The rating and review count are
+// part of the movie's representation, but change with its reviews rather than its version, so
+// they are included as well. Otherwise a client would keep being told that its copy of the
+// movie is current after a review was added.
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d-%d-%d-%s"`, movie.ID, movie.Version, movie.ReviewCount, strconv.FormatFloat(movie.Rating, 'f', -1, 64))
+}
+
+// The etagMatches() helper reports whether an If-Match or If-None-Match header value
+// matches the given entity tag. The header may contain "*" or a comma-separated list of
+// tags. If weak is true, the weak comparison function from RFC 9110 is used (which
+// ignores the W/ prefix), otherwise weak tags never match.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The checkIfMatch() helper evaluates the If-Match precondition of a request against the
+// current entity tag of the resource. If the request shouldn't proceed, it sends a 412
+// Precondition Failed (or 428 Precondition Required) response and returns false.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	ifMatch := r.Header.Get("If-Match")
+
+	if ifMatch == "" {
+		if app.config.preconditions.requireIfMatch {
+			app.preconditionRequiredResponse(w, r)
+			return false
+		}
+
+		return true
+	}
+
+	if !etagMatches(ifMatch, etag, false) {
+		app.preconditionFailedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// The currentUser() helper returns the full record of the authenticated user. Requests made with
+// a JWT only carry the user's ID and activation state, so in that case the user is loaded from
+// the database. If that fails, an error response is sent and false is returned.
+func (app *application) currentUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	user := app.contextGetUser(r)
+	if app.contextGetClaims(r) == nil {
+		return user, true
+	}
+
+	user, err := app.models.Users.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
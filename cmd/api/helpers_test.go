@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/navarrovmn/internal/data"
+)
+
+func TestReadJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode string
+		wantArgs []any
+	}{
+		{name: "valid", body: `{"title": "Moana", "runtime": "107 mins"}`},
+		{name: "empty", body: ``, wantCode: "empty-body"},
+		{name: "syntax error", body: `{"title": "Moana",}`, wantCode: "badly-formed-json-at", wantArgs: []any{int64(19)}},
+		{name: "unexpected end", body: `{"title": "Moana"`, wantCode: "badly-formed-json"},
+		{name: "wrong type for field", body: `{"title": 123}`, wantCode: "incorrect-json-type-for", wantArgs: []any{"title"}},
+		{name: "wrong type", body: `["Moana"]`, wantCode: "incorrect-json-type", wantArgs: []any{int64(1)}},
+		{name: "unknown field", body: `{"rating": 5}`, wantCode: "unknown-json-field", wantArgs: []any{"rating"}},
+		{name: "invalid runtime", body: `{"runtime": "107 minutes"}`, wantCode: "invalid-runtime-json"},
+		{name: "too large", body: `{"title": "` + strings.Repeat("a", 1_048_576) + `"}`, wantCode: "body-too-large", wantArgs: []any{int64(1_048_576)}},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst struct {
+				Title   string       `json:"title"`
+				Runtime data.Runtime `json:"runtime"`
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			err := app.readJSON(httptest.NewRecorder(), r, &dst)
+
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("readJSON() error = %v; want nil", err)
+				}
+				return
+			}
+
+			var requestErr *requestError
+			if !errors.As(err, &requestErr) {
+				t.Fatalf("readJSON() error = %v; want a request error", err)
+			}
+
+			if requestErr.message.Code != tt.wantCode || !slices.Equal(requestErr.message.Args, tt.wantArgs) {
+				t.Errorf("readJSON() error = %+v; want %s %v", requestErr.message, tt.wantCode, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestReadIDParam(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    int
+		wantErr bool
+	}{
+		{id: "1", want: 1},
+		{id: "42", want: 42},
+		{id: "abc", wantErr: true},
+		{id: "", wantErr: true},
+		{id: "1.5", wantErr: true},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			params := httprouter.Params{{Key: "id", Value: tt.id}}
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+
+			got, err := app.readIDParam(r)
+			if tt.wantErr {
+				var requestErr *requestError
+				if !errors.As(err, &requestErr) || requestErr.message.Code != "invalid-parameter" {
+					t.Errorf("readIDParam() error = %v; want an invalid-parameter request error", err)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("readIDParam() = %d, %v; want %d, nil", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tag := etag(42, 3)
+
+	tests := []struct {
+		name   string
+		header string
+		weak   bool
+		want   bool
+	}{
+		{name: "same tag", header: `"42-3"`, want: true},
+		{name: "other version", header: `"42-2"`, want: false},
+		{name: "other id", header: `"4-23"`, want: false},
+		{name: "unquoted", header: `42-3`, want: false},
+		{name: "wildcard", header: `*`, want: true},
+		{name: "in a list", header: `"1-1", "42-3"`, want: true},
+		{name: "list without spaces", header: `"1-1","42-3"`, want: true},
+		{name: "not in a list", header: `"1-1", "42-2"`, want: false},
+		{name: "weak tag with strong comparison", header: `W/"42-3"`, weak: false, want: false},
+		{name: "weak tag with weak comparison", header: `W/"42-3"`, weak: true, want: true},
+		{name: "weak and strong tags", header: `W/"42-3", "42-3"`, weak: false, want: true},
+		{name: "empty", header: ``, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.header, tag, tt.weak); got != tt.want {
+				t.Errorf("etagMatches(%q, %q, %v) = %v; want %v", tt.header, tag, tt.weak, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		ifMatch        string
+		requireIfMatch bool
+		want           bool
+		wantStatus     int
+	}{
+		{name: "no header", want: true},
+		{name: "no header when required", requireIfMatch: true, want: false, wantStatus: http.StatusPreconditionRequired},
+		{name: "matching", ifMatch: `"42-3"`, requireIfMatch: true, want: true},
+		{name: "stale", ifMatch: `"42-2"`, want: false, wantStatus: http.StatusPreconditionFailed},
+		{name: "weak", ifMatch: `W/"42-3"`, want: false, wantStatus: http.StatusPreconditionFailed},
+		{name: "wildcard", ifMatch: `*`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.preconditions.requireIfMatch = tt.requireIfMatch
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/42", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+
+			if got := app.checkIfMatch(w, r, etag(42, 3)); got != tt.want {
+				t.Fatalf("checkIfMatch() = %v; want %v", got, tt.want)
+			}
+
+			if !tt.want && w.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"application/json", "text/csv", "application/x-ndjson"}
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "no header", accept: "", want: "application/json"},
+		{name: "any type", accept: "*/*", want: "application/json"},
+		{name: "exact", accept: "text/csv", want: "text/csv"},
+		{name: "case insensitive", accept: "Text/CSV", want: "text/csv"},
+		{name: "parameters ignored", accept: "application/x-ndjson; charset=utf-8", want: "application/x-ndjson"},
+		{name: "equal quality picks first offer from list", accept: "text/html, text/csv, application/json", want: "application/json"},
+		{name: "highest quality wins", accept: "application/json;q=0.1, text/csv;q=0.9", want: "text/csv"},
+		{name: "missing quality is 1", accept: "text/csv;q=0.1, application/json", want: "application/json"},
+		{name: "equal quality picks first offer", accept: "application/x-ndjson;q=0.5, text/csv;q=0.5", want: "text/csv"},
+		{name: "refused type", accept: "application/json;q=0", want: ""},
+		{name: "refused type with any type", accept: "application/json;q=0, */*", want: "text/csv"},
+		{name: "refused types with type wildcard", accept: "application/*, application/json;q=0", want: "application/x-ndjson"},
+		{name: "more specific range wins", accept: "text/*;q=0.2, text/csv;q=0.9, */*;q=0.5", want: "text/csv"},
+		{name: "other parameters before quality", accept: "text/csv; charset=utf-8; q=0.8, application/json;q=0.3", want: "text/csv"},
+		{name: "invalid quality refuses", accept: "text/csv;q=high", want: ""},
+		{name: "uppercase Q", accept: "text/csv;Q=0.9, application/json;q=0.1", want: "text/csv"},
+		{name: "type wildcard", accept: "text/*", want: "text/csv"},
+		{name: "type wildcard picks first offer", accept: "application/*", want: "application/json"},
+		{name: "any type after others", accept: "text/html, */*;q=0.1", want: "application/json"},
+		{name: "none acceptable", accept: "text/html, image/*", want: ""},
+	}
+
+	app := &application{}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/export", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			if got := app.negotiateContentType(r, offers...); got != tt.want {
+				t.Errorf("negotiateContentType(%q) = %q; want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+// A movie's entity tag has to change when it is reviewed, even though its version doesn't, so
+// that a GET with the entity tag from before the review doesn't get a 304 Not Modified.
+func TestMovieETagChangesWithReviews(t *testing.T) {
+	before := &data.Movie{ID: 42, Version: 3, Rating: 7.5, ReviewCount: 2}
+
+	tests := []struct {
+		name  string
+		after data.Movie
+		want  bool
+	}{
+		{name: "unchanged", after: data.Movie{ID: 42, Version: 3, Rating: 7.5, ReviewCount: 2}, want: true},
+		{name: "review created", after: data.Movie{ID: 42, Version: 3, Rating: 8, ReviewCount: 3}, want: false},
+		{name: "review created with the same rating", after: data.Movie{ID: 42, Version: 3, Rating: 7.5, ReviewCount: 3}, want: false},
+		{name: "review updated", after: data.Movie{ID: 42, Version: 3, Rating: 7, ReviewCount: 2}, want: false},
+		{name: "review deleted", after: data.Movie{ID: 42, Version: 3, Rating: 0, ReviewCount: 0}, want: false},
+		{name: "movie updated", after: data.Movie{ID: 42, Version: 4, Rating: 7.5, ReviewCount: 2}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// showMovieHandler() compares If-None-Match with the weak comparison.
+			if got := etagMatches(movieETag(before), movieETag(&tt.after), true); got != tt.want {
+				t.Errorf("If-None-Match %s matches %s = %v; want %v", movieETag(before), movieETag(&tt.after), got, tt.want)
+			}
+		})
+	}
+}
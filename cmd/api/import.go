@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/validator"
+)
+
+// An importRow holds a movie read from one row of an import file, along with any errors
+// found while parsing or validating it.
+type importRow struct {
+	row    int
+	movie  *data.Movie
+	errors map[string]validator.Message
+}
+
+// An importResult reports the outcome of importing one row.
+type importResult struct {
+	Row    int               `json:"row"`
+	ID     int64             `json:"id,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// The importMoviesHandler() creates movies in bulk from a CSV or NDJSON request body. Every
+// row is validated with data.ValidateMovie(), and the valid rows are inserted together in a
+// single transaction. The response reports the created ID or the errors for each row. If the
+// dry_run parameter is set, the rows are validated but nothing is written.
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	dryRun := app.readBool(r.URL.Query(), "dry_run", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Import files are much larger than regular JSON request bodies, so allow up to 10MB
+	// and extend the server's read and write deadlines for this request.
+	maxBytes := 10_485_760
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(2 * time.Minute)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var (
+		rows []*importRow
+		err  error
+	)
+
+	switch mediaType {
+	case "text/csv":
+		rows, err = app.readMovieCSV(r.Body)
+	case "application/x-ndjson":
+		rows, err = app.readMovieNDJSON(r.Body)
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "text/csv", "application/x-ndjson")
+		return
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if len(rows) == 0 {
+		app.badRequestResponse(w, r, newRequestError("no-movies"))
+		return
+	}
+
+	var valid []*data.Movie
+
+	for _, row := range rows {
+		if row.errors != nil {
+			continue
+		}
+
+		v := validator.New()
+		if data.ValidateMovie(v, row.movie); !v.Valid() {
+			row.errors = v.Errors
+			continue
+		}
+
+		valid = append(valid, row.movie)
+	}
+
+	if !dryRun {
+		err = app.models.Movies.InsertMany(valid, app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// An import is recorded as one event, rather than one for each movie.
+		ids := make([]int64, len(valid))
+		for i, movie := range valid {
+			ids[i] = movie.ID
+		}
+
+		app.audit(r, data.AuditMovieImport, "", 0, nil, map[string]any{"movie_ids": ids})
+	}
+
+	results := make([]importResult, len(rows))
+	for i, row := range rows {
+		results[i] = importResult{Row: row.row, ID: row.movie.ID, Errors: app.translateErrors(r, row.errors)}
+	}
+
+	summary := map[string]any{
+		"total":   len(rows),
+		"valid":   len(valid),
+		"invalid": len(rows) - len(valid),
+		"dry_run": dryRun,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results, "summary": summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readMovieCSV() helper reads movies from CSV data. The first record must be a header
+// naming the title, year, runtime and genres columns (in any order; other columns, such as
+// id and version in an export file, are ignored). Runtimes use the "<runtime> mins" format
+// and the genres are separated by commas within their field.
+func (app *application) readMovieCSV(body io.Reader) ([]*importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, newRequestError("empty-body")
+		}
+		return nil, csvError(err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, newRequestError("missing-csv-column", name)
+		}
+	}
+
+	var rows []*importRow
+
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, csvError(err)
+		}
+
+		row := &importRow{row: n, movie: &data.Movie{}}
+		v := validator.New()
+
+		field := func(name string) string {
+			if i := columns[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row.movie.Title = field("title")
+
+		if s := field("year"); s != "" {
+			year, err := strconv.ParseInt(s, 10, 32)
+			v.Check(err == nil, "year", "integer")
+			row.movie.Year = int32(year)
+		}
+
+		if s := field("runtime"); s != "" {
+			runtime, err := data.ParseRuntime(s)
+			v.Check(err == nil, "runtime", "runtime-format")
+			row.movie.Runtime = runtime
+		}
+
+		row.movie.Genres = []string{}
+		for _, genre := range strings.Split(field("genres"), ",") {
+			if genre = strings.TrimSpace(genre); genre != "" {
+				row.movie.Genres = append(row.movie.Genres, genre)
+			}
+		}
+
+		if !v.Valid() {
+			row.errors = v.Errors
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// csvError returns the request error for a CSV reader error, with the line which it is on.
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return newRequestError("badly-formed-csv", parseErr.Line)
+	}
+
+	return err
+}
+
+// The readMovieNDJSON() helper reads movies from newline-delimited JSON, where each
+// non-blank line is an object with the same fields as the createMovieHandler() input.
+func (app *application) readMovieNDJSON(body io.Reader) ([]*importRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1_048_576)
+
+	var rows []*importRow
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var input struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+
+		row := &importRow{row: n, movie: &data.Movie{}}
+
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil {
+			row.errors = map[string]validator.Message{"row": {Code: "invalid-json", Args: []any{err.Error()}}}
+		} else {
+			row.movie.Title = input.Title
+			row.movie.Year = input.Year
+			row.movie.Runtime = input.Runtime
+			row.movie.Genres = input.Genres
+		}
+
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
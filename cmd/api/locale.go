@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/i18n"
+	"github.com/navarrovmn/internal/validator"
+)
+
+// The requestLocale() method returns the locale for messages in the response to a request. The
+// Accept-Language header comes first, then the locale of the authenticated user, and then the
+// default locale. Users authenticated with a JWT only carry their ID, so their locale isn't
+// known without loading them, and the default is used instead.
+func (app *application) requestLocale(r *http.Request) string {
+	if locale := i18n.Negotiate(r.Header.Get("Accept-Language")); locale != "" {
+		return locale
+	}
+
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if ok && user.Locale != "" {
+		return user.Locale
+	}
+
+	return i18n.Default
+}
+
+// The matchLocale() helper returns the supported locale for a language tag sent by the client,
+// such as "pt-BR" for "pt-br". A tag which isn't supported is returned as it is, so that
+// data.ValidateLocale() reports it.
+func matchLocale(tag string) string {
+	if locale, ok := i18n.Match(tag); ok {
+		return locale
+	}
+
+	return tag
+}
+
+// The translate() method returns the message for the code in the locale of the request.
+func (app *application) translate(r *http.Request, code string, args ...any) string {
+	return i18n.Translate(app.requestLocale(r), code, args...)
+}
+
+// The translateErrors() method returns the validation errors as messages in the locale of the
+// request, keyed by field.
+func (app *application) translateErrors(r *http.Request, errors map[string]validator.Message) map[string]string {
+	if errors == nil {
+		return nil
+	}
+
+	locale := app.requestLocale(r)
+	messages := make(map[string]string, len(errors))
+
+	for key, message := range errors {
+		messages[key] = i18n.Translate(locale, message.Code, message.Args...)
+	}
+
+	return messages
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/navarrovmn/internal/data"
+	"github.com/tomasen/realip"
+	"net/http"
+	"time"
+)
+
+// A loginAttempt is an attempt to sign in which has already been counted as a failure, before
+// the password or code was checked. It holds the failures so far, including the attempt itself.
+type loginAttempt struct {
+	email         string
+	ip            string
+	emailFailures int
+	ipFailures    int
+}
+
+// The reserveLoginAttempt() method checks whether the client can try to sign in as the email
+// address, and if so counts the attempt as a failure straight away. Otherwise it returns how long
+// the client has to wait. Failed attempts are counted per email address and per IP address, so
+// that neither guessing many passwords for one account, nor one password for many accounts, gets
+// far. Each failure for an email address doubles the wait before the next attempt, and once
+// either count reaches its threshold, signing in is locked for the lockout duration.
+//
+// The check and the count happen in one transaction, with the counts locked, so that attempts
+// made at the same time wait for each other instead of all being let through. An attempt which
+// turns out not to have failed is taken back with releaseLoginAttempt().
+func (app *application) reserveLoginAttempt(r *http.Request, email string) (*loginAttempt, time.Duration, error) {
+	attempt := &loginAttempt{email: email, ip: realip.FromRequest(r)}
+
+	if !app.config.lockout.enabled {
+		return attempt, 0, nil
+	}
+
+	emailKey := data.LoginFailureKeyForEmail(attempt.email)
+	ipKey := data.LoginFailureKeyForIP(attempt.ip)
+
+	var wait time.Duration
+
+	err := app.models.WithTx(func(tx *sql.Tx) error {
+		failures, err := app.models.LoginFailures.GetAllForUpdateTx(tx, emailKey, ipKey)
+		if err != nil {
+			return err
+		}
+
+		wait = app.loginWait(failures, emailKey, time.Now())
+		if wait > 0 {
+			return nil
+		}
+
+		attempt.emailFailures, err = app.models.LoginFailures.RecordTx(tx, emailKey, app.config.lockout.window)
+		if err != nil {
+			return err
+		}
+
+		attempt.ipFailures, err = app.models.LoginFailures.RecordTx(tx, ipKey, app.config.lockout.window)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return attempt, wait, nil
+}
+
+// The loginWait() method returns how long to wait before the next attempt to sign in, given the
+// failures for the email address and IP address at the time now. Retry-After is in whole
+// seconds, so the wait is rounded up rather than tell the client to come back before it's
+// allowed to.
+func (app *application) loginWait(failures []*data.LoginFailure, emailKey string, now time.Time) time.Duration {
+	var wait time.Duration
+
+	for _, failure := range failures {
+		if failure.LockedUntil != nil && failure.LockedUntil.After(now) {
+			wait = max(wait, failure.LockedUntil.Sub(now))
+		}
+
+		if failure.Key == emailKey && now.Sub(failure.LastFailureAt) < app.config.lockout.window {
+			wait = max(wait, failure.LastFailureAt.Add(app.loginBackoff(failure.Failures)).Sub(now))
+		}
+	}
+
+	if remainder := wait % time.Second; remainder > 0 {
+		wait += time.Second - remainder
+	}
+
+	return wait
+}
+
+// The loginBackoff() method returns the wait after the given number of consecutive failures:
+// the back-off base after the first one, doubling with each one after that up to the maximum.
+func (app *application) loginBackoff(failures int) time.Duration {
+	backoff := app.config.lockout.backoff
+	if backoff <= 0 || failures < 1 {
+		return 0
+	}
+
+	for i := 1; i < failures && backoff < app.config.lockout.backoffMax; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, app.config.lockout.backoffMax)
+}
+
+// The recordLoginFailure() method handles an attempt to sign in which failed. It was counted
+// already, so if it took the email address to the lockout threshold, the email address is
+// locked, and if there is a user with it, they are sent an email to let them know. The same goes
+// for the IP address. Errors are only logged, so that they don't change the response to the
+// failed attempt.
+func (app *application) recordLoginFailure(r *http.Request, attempt *loginAttempt, user *data.User) {
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+
+	app.auditAs(r, 0, data.AuditLoginFailure, "user", userID, nil, map[string]any{"email": attempt.email})
+
+	if !app.config.lockout.enabled {
+		return
+	}
+
+	lockedUntil := time.Now().Add(app.config.lockout.duration)
+
+	if attempt.emailFailures >= app.config.lockout.threshold {
+		err := app.models.LoginFailures.Lock(data.LoginFailureKeyForEmail(attempt.email), lockedUntil)
+		if err != nil {
+			app.logError(r, err)
+		}
+
+		if attempt.emailFailures == app.config.lockout.threshold && user != nil {
+			app.logger.Warn("account locked after failed sign in attempts", "user_id", user.ID, "ip", attempt.ip)
+
+			err = app.models.Outbox.Insert(&data.OutboxMessage{
+				Recipient: user.Email,
+				Template:  "user_lockout.tmpl",
+				Locale:    user.Locale,
+				Data: map[string]any{
+					"ip":          attempt.ip,
+					"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+				},
+			})
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+	}
+
+	if attempt.ipFailures >= app.config.lockout.ipThreshold {
+		err := app.models.LoginFailures.Lock(data.LoginFailureKeyForIP(attempt.ip), lockedUntil)
+		if err != nil {
+			app.logError(r, err)
+		}
+
+		if attempt.ipFailures == app.config.lockout.ipThreshold {
+			app.logger.Warn("IP address locked after failed sign in attempts", "ip", attempt.ip)
+		}
+	}
+}
+
+// The releaseLoginAttempt() method takes back an attempt to sign in which turned out not to have
+// failed, such as one with the right password. Errors are only logged.
+func (app *application) releaseLoginAttempt(r *http.Request, attempt *loginAttempt) {
+	if !app.config.lockout.enabled {
+		return
+	}
+
+	err := app.models.LoginFailures.Release(data.LoginFailureKeyForEmail(attempt.email), data.LoginFailureKeyForIP(attempt.ip))
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The clearLoginFailures() method forgets the failed attempts for the email address once its
+// user has signed in. Failures from the IP address are kept, so that one account which an
+// attacker controls can't be used to reset their count.
+func (app *application) clearLoginFailures(r *http.Request, email string) {
+	if !app.config.lockout.enabled {
+		return
+	}
+
+	_, err := app.models.LoginFailures.Clear(data.LoginFailureKeyForEmail(email))
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The unlockUserHandler() lets an administrator lift the lockout on a user's account, and forget
+// its failed sign in attempts.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := app.models.LoginFailures.Clear(data.LoginFailureKeyForEmail(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditLoginUnlock, "user", user.ID, nil, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/navarrovmn/internal/data"
+)
+
+func newLockoutApp() *application {
+	app := &application{}
+	app.config.lockout.enabled = true
+	app.config.lockout.window = 15 * time.Minute
+	app.config.lockout.backoff = time.Second
+	app.config.lockout.backoffMax = 30 * time.Second
+	return app
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: -1, want: 0},
+		{failures: 0, want: 0},
+		{failures: 1, want: time.Second},
+		{failures: 2, want: 2 * time.Second},
+		{failures: 3, want: 4 * time.Second},
+		{failures: 5, want: 16 * time.Second},
+		{failures: 6, want: 30 * time.Second},
+		{failures: 7, want: 30 * time.Second},
+		{failures: 1000, want: 30 * time.Second},
+	}
+
+	app := newLockoutApp()
+
+	for _, tt := range tests {
+		if got := app.loginBackoff(tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginBackoffDisabled(t *testing.T) {
+	app := newLockoutApp()
+	app.config.lockout.backoff = 0
+
+	if got := app.loginBackoff(5); got != 0 {
+		t.Errorf("loginBackoff(5) = %v; want 0", got)
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	emailKey := data.LoginFailureKeyForEmail("Alice@Example.com")
+	ipKey := data.LoginFailureKeyForIP("203.0.113.7")
+
+	at := func(d time.Duration) *time.Time {
+		until := now.Add(d)
+		return &until
+	}
+
+	tests := []struct {
+		name     string
+		failures []*data.LoginFailure
+		want     time.Duration
+	}{
+		{
+			name: "no failures",
+			want: 0,
+		},
+		{
+			name:     "reserved row without failures",
+			failures: []*data.LoginFailure{{Key: emailKey, Failures: 0, LastFailureAt: now}},
+			want:     0,
+		},
+		{
+			name:     "back-off after failures",
+			failures: []*data.LoginFailure{{Key: emailKey, Failures: 3, LastFailureAt: now.Add(-time.Second)}},
+			want:     3 * time.Second,
+		},
+		{
+			name:     "back-off rounded up",
+			failures: []*data.LoginFailure{{Key: emailKey, Failures: 1, LastFailureAt: now.Add(-100 * time.Millisecond)}},
+			want:     time.Second,
+		},
+		{
+			name:     "back-off over",
+			failures: []*data.LoginFailure{{Key: emailKey, Failures: 2, LastFailureAt: now.Add(-5 * time.Second)}},
+			want:     0,
+		},
+		{
+			name:     "failures outside the window",
+			failures: []*data.LoginFailure{{Key: emailKey, Failures: 10, LastFailureAt: now.Add(-time.Hour)}},
+			want:     0,
+		},
+		{
+			name:     "no back-off for IP addresses",
+			failures: []*data.LoginFailure{{Key: ipKey, Failures: 10, LastFailureAt: now}},
+			want:     0,
+		},
+		{
+			name:     "locked email address",
+			failures: []*data.LoginFailure{{Key: emailKey, Failures: 1, LastFailureAt: now.Add(-time.Hour), LockedUntil: at(10 * time.Minute)}},
+			want:     10 * time.Minute,
+		},
+		{
+			name:     "locked IP address",
+			failures: []*data.LoginFailure{{Key: ipKey, Failures: 50, LastFailureAt: now, LockedUntil: at(90 * time.Second)}},
+			want:     90 * time.Second,
+		},
+		{
+			name:     "lock expired",
+			failures: []*data.LoginFailure{{Key: ipKey, Failures: 50, LastFailureAt: now.Add(-time.Hour), LockedUntil: at(-time.Minute)}},
+			want:     0,
+		},
+		{
+			name: "longest wait wins",
+			failures: []*data.LoginFailure{
+				{Key: emailKey, Failures: 4, LastFailureAt: now},
+				{Key: ipKey, Failures: 20, LastFailureAt: now, LockedUntil: at(5 * time.Second)},
+			},
+			want: 8 * time.Second,
+		},
+	}
+
+	app := newLockoutApp()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := app.loginWait(tt.failures, emailKey, now); got != tt.want {
+				t.Errorf("loginWait() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/jwt"
 	"github.com/navarrovmn/internal/mailer"
 	"github.com/navarrovmn/internal/vcs"
 
@@ -46,18 +50,78 @@ type config struct {
 		password string
 		sender   string
 	}
+	mail struct {
+		transport string
+		dir       string
+	}
 	cors struct {
 		trustedOrigins []string
 	}
+	preconditions struct {
+		requireIfMatch bool
+	}
+	trash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+	errors struct {
+		format string
+	}
+	tokens struct {
+		authenticationTTL time.Duration
+		accessTTL         time.Duration
+		refreshTTL        time.Duration
+	}
+	auth struct {
+		mode string
+	}
+	mfa struct {
+		requiredPermissions []string
+	}
+	roles struct {
+		defaultRole string
+	}
+	audit struct {
+		hashChain bool
+	}
+	outbox struct {
+		workers      int
+		pollInterval time.Duration
+		maxAttempts  int
+		backoff      time.Duration
+		backoffMax   time.Duration
+	}
+	lockout struct {
+		enabled     bool
+		threshold   int
+		ipThreshold int
+		duration    time.Duration
+		window      time.Duration
+		backoff     time.Duration
+		backoffMax  time.Duration
+	}
+	jwt struct {
+		algorithm       string
+		issuer          string
+		keys            []jwtKeyMaterial
+		checkRevocation bool
+	}
+}
+
+// The jwtKeyMaterial struct holds a JWT key as given on the command line, before it is parsed.
+type jwtKeyMaterial struct {
+	id       string
+	material []byte
 }
 
 // Define application struct to hold the dependencies for HTTP handlers, helpers and middleware.
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *slog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	jwtKeys *jwt.KeySet
+	wg      sync.WaitGroup
 }
 
 func main() {
@@ -82,11 +146,77 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP Password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no.reply@greenlight.victornavarro.net>", "SMTP Sender")
 
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "Mail transport (smtp|dir|log|memory)")
+	flag.StringVar(&cfg.mail.dir, "mail-dir", "mail", "Directory for .eml files with the dir mail transport")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	flag.BoolVar(&cfg.preconditions.requireIfMatch, "require-if-match", false, "Require an If-Match header when updating or deleting versioned resources (movies, revisions, reviews, people, roles and users)")
+
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted movies are kept in the trash (0 to keep them forever)")
+	flag.DurationVar(&cfg.trash.purgeInterval, "trash-purge-interval", time.Hour, "How often to purge expired movies from the trash")
+
+	flag.StringVar(&cfg.errors.format, "error-format", "json", "Error response format (json|problem); clients can also ask for problem details with the Accept header")
+
+	flag.DurationVar(&cfg.tokens.authenticationTTL, "authentication-token-ttl", 24*time.Hour, "Lifetime of authentication tokens issued without a refresh token")
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of authentication tokens issued with a refresh token")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "stateful", "Authentication token mode (stateful|jwt); JWTs carry the user's permissions, so permission changes only apply once they expire")
+	flag.StringVar(&cfg.jwt.algorithm, "jwt-alg", jwt.HS256, "JWT signing algorithm (HS256|EdDSA)")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "greenlight", "JWT issuer, set in the JWTs which are issued and required in those which are accepted")
+	flag.BoolVar(&cfg.jwt.checkRevocation, "jwt-check-revocation", false, "Check the database on every request that a JWT's session hasn't been revoked and its user isn't suspended; otherwise signing out and suspensions only stop JWTs once they expire")
+
+	// JWT keys are given as kid=material, either on the command line or in a file. Both
+	// flags can be repeated: the first key signs new tokens, and the rest are only used to
+	// verify tokens which they signed before the keys were rotated.
+	flag.Func("jwt-key", "JWT key as kid=material: an HS256 secret or a PEM encoded EdDSA key (repeatable)", func(val string) error {
+		id, material, found := strings.Cut(val, "=")
+		if !found {
+			return errors.New("must be in the form kid=material")
+		}
+		cfg.jwt.keys = append(cfg.jwt.keys, jwtKeyMaterial{id: id, material: []byte(material)})
+		return nil
+	})
+	flag.Func("jwt-key-file", "JWT key as kid=path to a file holding the key material (repeatable)", func(val string) error {
+		id, path, found := strings.Cut(val, "=")
+		if !found {
+			return errors.New("must be in the form kid=path")
+		}
+		material, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		cfg.jwt.keys = append(cfg.jwt.keys, jwtKeyMaterial{id: id, material: bytes.TrimSpace(material)})
+		return nil
+	})
+
+	flag.Func("mfa-required-permissions", "Permissions which can only be used by users with two-factor authentication enabled (space separated)", func(val string) error {
+		cfg.mfa.requiredPermissions = strings.Fields(val)
+		return nil
+	})
+
+	flag.BoolVar(&cfg.lockout.enabled, "lockout-enabled", true, "Enable back-off and lockout after failed sign in attempts")
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", 10, "Failed sign in attempts for an email address before it is locked")
+	flag.IntVar(&cfg.lockout.ipThreshold, "lockout-ip-threshold", 100, "Failed sign in attempts from an IP address before it is locked")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", 15*time.Minute, "How long sign in stays locked")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", time.Hour, "How long failed sign in attempts are counted for")
+	flag.DurationVar(&cfg.lockout.backoff, "lockout-backoff", time.Second, "Wait after a failed sign in attempt, doubled for each consecutive failure (0 to disable)")
+	flag.DurationVar(&cfg.lockout.backoffMax, "lockout-backoff-max", time.Minute, "Maximum wait between failed sign in attempts")
+
+	flag.StringVar(&cfg.roles.defaultRole, "default-role", "viewer", "Role given to newly registered users (empty for none)")
+
+	flag.BoolVar(&cfg.audit.hashChain, "audit-hash-chain", false, "Chain audit events together with hashes, so that tampering can be detected")
+
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of workers sending emails from the outbox (0 to not send any)")
+	flag.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", time.Second, "How often workers check the outbox for emails to send")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 10, "Attempts to send an email before giving up on it")
+	flag.DurationVar(&cfg.outbox.backoff, "outbox-backoff", 30*time.Second, "Wait after an email fails to send, doubled for each further failure")
+	flag.DurationVar(&cfg.outbox.backoffMax, "outbox-backoff-max", time.Hour, "Maximum wait between attempts to send an email")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -98,6 +228,23 @@ func main() {
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	if !slices.Contains([]string{"json", "problem"}, cfg.errors.format) {
+		logger.Error(fmt.Sprintf("unknown error format %q", cfg.errors.format))
+		os.Exit(1)
+	}
+
+	jwtKeys, err := openJWTKeys(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	mailTransport, err := openMailTransport(cfg, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.Error(err.Error())
@@ -107,11 +254,23 @@ func main() {
 	defer db.Close()
 	logger.Info("database connection pool established")
 
+	models := data.NewModels(db)
+
+	// Check the default role now, rather than when the first user registers.
+	if cfg.roles.defaultRole != "" {
+		_, err = models.Roles.GetByName(cfg.roles.defaultRole)
+		if err != nil {
+			logger.Error(fmt.Sprintf("default role %q: %s", cfg.roles.defaultRole, err))
+			os.Exit(1)
+		}
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:  cfg,
+		logger:  logger,
+		models:  models,
+		mailer:  mailer.New(mailTransport, cfg.smtp.sender),
+		jwtKeys: jwtKeys,
 	}
 
 	expvar.NewString("version").Set(version)
@@ -135,6 +294,51 @@ func main() {
 	}
 }
 
+// The openMailTransport() function returns the sender for the configured mail transport. The
+// dir, log and memory transports don't send anything, for development and testing.
+func openMailTransport(cfg config, logger *slog.Logger) (mailer.Sender, error) {
+	switch cfg.mail.transport {
+	case "smtp":
+		return mailer.NewSMTPSender(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "dir":
+		return mailer.NewDirSender(cfg.mail.dir)
+	case "log":
+		return mailer.NewLogSender(logger), nil
+	case "memory":
+		return mailer.NewMemorySender(), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.mail.transport)
+	}
+}
+
+// The openJWTKeys() function parses the JWT keys from the config. It returns a nil key set when
+// no keys are given, which is only allowed for the stateful authentication mode.
+func openJWTKeys(cfg config) (*jwt.KeySet, error) {
+	switch cfg.auth.mode {
+	case "stateful":
+		if len(cfg.jwt.keys) == 0 {
+			return nil, nil
+		}
+	case "jwt":
+		if len(cfg.jwt.keys) == 0 {
+			return nil, errors.New("the jwt authentication mode needs at least one -jwt-key or -jwt-key-file")
+		}
+	default:
+		return nil, fmt.Errorf("unknown authentication mode %q", cfg.auth.mode)
+	}
+
+	keys := make([]*jwt.Key, 0, len(cfg.jwt.keys))
+	for _, k := range cfg.jwt.keys {
+		key, err := jwt.NewKey(k.id, cfg.jwt.algorithm, k.material)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return jwt.NewKeySet(keys...)
+}
+
 // The openDB() function returns a sql.DB connection pool.
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
 	"expvar"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,13 +38,27 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		token := headerParts[1]
+
+		// JWTs are made of three dot separated parts, which stateful tokens never contain.
+		// Both kinds are accepted whatever the authentication mode, so that switching mode
+		// doesn't sign everybody out.
+		if strings.Count(token, ".") == 2 {
+			app.authenticateJWT(w, r, next, token)
+			return
+		}
+
+		if data.IsAPIKey(token) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		session, err := app.models.Tokens.GetSession(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -51,7 +68,157 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+
+		user, err := app.models.Users.Get(session.UserID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if user.IsSuspended() {
+			app.suspendedAccountResponse(w, r)
+			return
+		}
+
+		// Record when the session was last used, at most once a minute so that busy
+		// clients don't cause a write on every request. A failure here shouldn't stop
+		// the request, so it's only logged.
+		if session.LastUsedAt == nil || time.Since(*session.LastUsedAt) > time.Minute {
+			err = app.models.Tokens.TouchSession(session.TokenID, r.UserAgent(), realip.FromRequest(r))
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetSessionID(r, session.ID)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The authenticateJWT() method authenticates a request made with a JWT. The token is verified
+// with the JWT keys alone, so by default no database lookup is needed, and signing out,
+// revoking the session or suspending the user only stops the JWT from working once it expires.
+// The lifetime of JWTs is the access token TTL for clients with a refresh token, so it should
+// be kept short. With -jwt-check-revocation, the session and user are checked on every request
+// instead. The user is built from the claims, so handlers which need more than the user's ID
+// and activation state should use currentUser().
+func (app *application) authenticateJWT(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	if app.jwtKeys == nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	claims, err := app.jwtKeys.Verify(token, app.config.jwt.issuer, time.Now())
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if app.config.jwt.checkRevocation {
+		active, suspended, err := app.models.Tokens.SessionStatus(userID, claims.SessionID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Suspending a user revokes their sessions as well, but is checked first so that
+		// the client is told why.
+		if suspended {
+			app.suspendedAccountResponse(w, r)
+			return
+		}
+
+		if !active {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+	}
+
+	r = app.contextSetUser(r, &data.User{ID: userID, Activated: claims.Activated})
+	r = app.contextSetSessionID(r, claims.SessionID)
+	r = app.contextSetClaims(r, claims)
+	r = app.contextSetPermissions(r, data.Permissions(claims.Permissions))
+
+	next.ServeHTTP(w, r)
+}
+
+// The authenticateAPIKey() method authenticates a request made with an API key. The request only
+// gets the permissions which the key was given, and which its user still has.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	key, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.IsSuspended() {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForAPIKey(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// As with sessions, usage is recorded at most once a minute.
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		err = app.models.APIKeys.Touch(key.ID)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, permissions)
+
+	next.ServeHTTP(w, r)
+}
+
+// The requestID middleware gives every request a unique ID in the form of a random (version 4)
+// UUID. The ID is added to the request context, so it can be included in log entries and error
+// responses, and returned to the client in the X-Request-Id header.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+
+		_, err := rand.Read(b)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		requestID := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+		w.Header().Set("X-Request-Id", requestID)
+		r = app.contextSetRequestID(r, requestID)
 
 		next.ServeHTTP(w, r)
 	})
@@ -158,10 +325,15 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		// JWTs and API keys carry their own permissions. Otherwise, the user's apply.
+		permissions, ok := app.contextGetPermissions(r)
+		if !ok {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 
 		if !permissions.Include(code) {
@@ -169,6 +341,21 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// Service accounts can't enrol in two-factor authentication, and are only
+		// reachable through API keys, so the requirement doesn't apply to them.
+		if slices.Contains(app.config.mfa.requiredPermissions, code) && !user.ServiceAccount {
+			enabled, err := app.models.TOTP.Enabled(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if !enabled {
+				app.mfaRequiredResponse(w, r)
+				return
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	}
 
@@ -185,10 +372,11 @@ func (app *application) enableCors(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-Id")
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -41,16 +41,19 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Call the Insert() on our movies model in a pointer to the validated movie struct.
 	// This creates the record and update the movie struct with system generated info
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(movie, app.contextGetUser(r).ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.audit(r, data.AuditMovieCreate, "movie", movie.ID, nil, movie)
+
 	// When sending a HTTP response, we want to include a Location header to let
 	// the client know which URL they can find the newly-created resource at.
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 
 	// Write a JSON response with a 201 Created status code, the movie data in the
 	// response body and the Location header.
@@ -81,7 +84,18 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	// If the client already has the current representation of the movie, send a 304
+	// Not Modified response with no body instead of the movie data.
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, headers.Get("ETag"), true) {
+		w.Header().Set("ETag", headers.Get("ETag"))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -90,8 +104,9 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	// Define input struct for consistency with other handlers
 	var input struct {
-		Title  string
-		Genres []string
+		Title    string
+		Genres   []string
+		PersonID int
 		data.Filters
 	}
 
@@ -102,17 +117,24 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Use helpers to extract the title and genres query string values.
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.PersonID = app.readInt(qs, "person", 0, v)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "rating", "-id", "-title", "-year", "-runtime", "-rating"}
+
+	// The presence of the cursor parameter switches to cursor pagination. An empty
+	// cursor requests the first page, and each response carries the next_cursor
+	// to send back for the following one.
+	input.Filters.CursorMode = qs.Has("cursor")
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, int64(input.PersonID), input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -145,6 +167,14 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// If the client sent an If-Match header, make sure it matches the version of the
+	// movie we have before going any further.
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
+		return
+	}
+
+	before := *movie
+
 	// Declare an input struct to hold the expected data from the client
 	var input struct {
 		Title   *string       `json:"title"`
@@ -178,9 +208,13 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(movie, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
+		// The movie was changed by someone else after it was fetched. A client which
+		// made a conditional request gets the conditional request failure response.
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -189,7 +223,12 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	app.audit(r, data.AuditMovieUpdate, "movie", movie.ID, before, movie)
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -203,7 +242,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(int64(id))
+	movie, err := app.models.Movies.Get(int64(id))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -214,6 +253,27 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
+		return
+	}
+
+	// The movie is only deleted if it is still at the version which was checked against the
+	// If-Match header, so a change made in between isn't lost.
+	err = app.models.Movies.Delete(movie.ID, movie.Version, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditMovieDelete, "movie", movie.ID, movie, nil)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
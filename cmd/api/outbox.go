@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/validator"
+)
+
+const (
+	// The most messages a worker claims at once.
+	outboxBatchSize = 10
+
+	// How long a claimed message is left for its worker, before other workers may try it.
+	// This has to be longer than sending an email can take.
+	outboxLease = time.Minute
+)
+
+// The deliverOutbox() method starts the configured number of workers, which send the messages
+// in the outbox. The workers stop when the ctx is cancelled.
+func (app *application) deliverOutbox(ctx context.Context) {
+	if app.config.outbox.workers <= 0 || app.config.outbox.pollInterval <= 0 {
+		return
+	}
+
+	for i := 0; i < app.config.outbox.workers; i++ {
+		app.background(func() {
+			ticker := time.NewTicker(app.config.outbox.pollInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					app.sendOutboxMessages(ctx)
+				}
+			}
+		})
+	}
+}
+
+// The sendOutboxMessages() method sends messages until there are none left which are due.
+func (app *application) sendOutboxMessages(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := app.models.Outbox.Claim(outboxBatchSize, outboxLease)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		if len(messages) == 0 {
+			return
+		}
+
+		for _, message := range messages {
+			app.sendOutboxMessage(message)
+		}
+	}
+}
+
+// The sendOutboxMessage() method sends one message and records the outcome. A message which
+// fails is retried after the back-off for its number of attempts, until it runs out of them.
+func (app *application) sendOutboxMessage(message *data.OutboxMessage) {
+	err := app.mailer.Send(message.Recipient, message.Template, message.Locale, message.Data)
+	if err == nil {
+		err = app.models.Outbox.MarkSent(message.ID)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	if message.Attempts < app.config.outbox.maxAttempts {
+		t := time.Now().Add(app.outboxBackoff(message.Attempts))
+		retryAt = &t
+	}
+
+	if retryAt != nil {
+		app.logger.Warn("sending email failed", "outbox_id", message.ID, "attempts", message.Attempts, "error", err.Error())
+	} else {
+		app.logger.Error("sending email failed for the last time", "outbox_id", message.ID, "attempts", message.Attempts, "error", err.Error())
+	}
+
+	err = app.models.Outbox.MarkFailed(message.ID, err.Error(), retryAt)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// The outboxBackoff() method returns the wait before the next attempt to send a message which
+// has failed the given number of times. It doubles with each attempt, up to the maximum.
+func (app *application) outboxBackoff(attempts int) time.Duration {
+	backoff := app.config.outbox.backoff
+
+	for i := 1; i < attempts && backoff < app.config.outbox.backoffMax; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, app.config.outbox.backoffMax)
+}
+
+func (app *application) listOutboxMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "next_attempt_at", "-id", "-next_attempt_at"}
+
+	v.Check(input.Status == "" || validator.PermittedValue(input.Status, data.OutboxPending, data.OutboxSent, data.OutboxDead), "status", "invalid-value")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	messages, metadata, err := app.models.Outbox.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"messages": messages, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showOutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	message, err := app.models.Outbox.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The retryOutboxMessageHandler() puts a dead message back in the queue.
+func (app *application) retryOutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	message, err := app.models.Outbox.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if message.Status != data.OutboxDead {
+		v := validator.New()
+		v.AddError("status", "not-dead")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	message, err = app.models.Outbox.Retry(message.ID)
+	if err != nil {
+		switch {
+		// Someone else retried the message in the meantime.
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The retryDeadOutboxMessagesHandler() puts every dead message back in the queue, for example
+// once a mail server which was down is back up.
+func (app *application) retryDeadOutboxMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	count, err := app.models.Outbox.RetryAllDead()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"retried": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		backoff    time.Duration
+		backoffMax time.Duration
+		attempts   int
+		want       time.Duration
+	}{
+		{name: "first attempt", backoff: 30 * time.Second, backoffMax: time.Hour, attempts: 1, want: 30 * time.Second},
+		{name: "second attempt", backoff: 30 * time.Second, backoffMax: time.Hour, attempts: 2, want: time.Minute},
+		{name: "fifth attempt", backoff: 30 * time.Second, backoffMax: time.Hour, attempts: 5, want: 8 * time.Minute},
+		{name: "capped", backoff: 30 * time.Second, backoffMax: time.Hour, attempts: 8, want: time.Hour},
+		{name: "many attempts", backoff: 30 * time.Second, backoffMax: time.Hour, attempts: 10_000, want: time.Hour},
+		{name: "no attempts yet", backoff: 30 * time.Second, backoffMax: time.Hour, attempts: 0, want: 30 * time.Second},
+		{name: "base over maximum", backoff: 2 * time.Hour, backoffMax: time.Hour, attempts: 1, want: time.Hour},
+		{name: "no back-off", backoff: 0, backoffMax: time.Hour, attempts: 3, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.outbox.backoff = tt.backoff
+			app.config.outbox.backoffMax = tt.backoffMax
+
+			if got := app.outboxBackoff(tt.attempts); got != tt.want {
+				t.Errorf("outboxBackoff(%d) = %v; want %v", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
@@ -24,6 +24,14 @@ func (app *application) serve() error {
 	}
 	shutdownError := make(chan error)
 
+	// Create a context for the long-running background tasks. It is cancelled when
+	// the server starts shutting down, so that app.wg.Wait() doesn't block forever.
+	ctx, stopBackgroundTasks := context.WithCancel(context.Background())
+	defer stopBackgroundTasks()
+
+	app.purgeDeletedMovies(ctx)
+	app.deliverOutbox(ctx)
+
 	go func() {
 		// Create a quit channel which carries os.Signal values
 		quit := make(chan os.Signal, 1)
@@ -45,6 +53,8 @@ func (app *application) serve() error {
 
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
 
+		stopBackgroundTasks()
+
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
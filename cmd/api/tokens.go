@@ -1,17 +1,25 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/jwt"
 	"github.com/navarrovmn/internal/validator"
+	"github.com/tomasen/realip"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+// The createAuthenticationTokenHandler() signs a user in, either with their email address and
+// password, or with a magic token from a magic link email.
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		MagicToken string `json:"magic_token"`
+		Refresh    bool   `json:"refresh"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -22,17 +30,49 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	v := validator.New()
 
-	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	if input.MagicToken != "" {
+		v.Check(input.Email == "" && input.Password == "", "magic_token", "conflicts-with-credentials")
+		v.Check(len(input.MagicToken) == 26, "magic_token", "exact-bytes", 26)
+	} else {
+		data.ValidateEmail(v, input.Email)
+		data.ValidatePasswordPlaintext(v, input.Password)
+	}
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	// Password guesses are throttled, and each one is counted before the password is checked,
+	// so that guesses made at the same time can't all get in under the threshold. The check
+	// comes before the user is looked up, so that email addresses without an account are
+	// treated in the same way.
+	var attempt *loginAttempt
+	if input.MagicToken == "" {
+		var retryAfter time.Duration
+		attempt, retryAfter, err = app.reserveLoginAttempt(r, input.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if retryAfter > 0 {
+			app.loginLockedResponse(w, r, retryAfter)
+			return
+		}
+	}
+
+	var user *data.User
+	if input.MagicToken != "" {
+		user, err = app.models.Users.GetForToken(data.ScopeMagicLink, input.MagicToken)
+	} else {
+		user, err = app.models.Users.GetByEmail(input.Email)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			if input.MagicToken == "" {
+				app.recordLoginFailure(r, attempt, nil)
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -40,23 +80,294 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	match, err := user.Password.Matches(input.Password)
+	// Service accounts can only authenticate with API keys.
+	if user.ServiceAccount {
+		if attempt != nil {
+			app.releaseLoginAttempt(r, attempt)
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if input.MagicToken != "" {
+		// Magic tokens can only be used once. Only the request which redeems the token gets
+		// a session, and any other magic links which the user was sent stop working too.
+		err = app.models.Tokens.Redeem(data.ScopeMagicLink, user.ID, input.MagicToken)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidCredentialsResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeMagicLink, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		match, err := user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !match {
+			app.recordLoginFailure(r, attempt, user)
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+
+		app.releaseLoginAttempt(r, attempt)
+	}
+
+	if user.IsSuspended() {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	// Users with two-factor authentication get a short-lived mfa token instead, which they
+	// exchange along with a code at /v1/tokens/mfa.
+	mfaEnabled, err := app.models.TOTP.Enabled(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	if !match {
-		app.invalidCredentialsResponse(w, r)
+
+	if mfaEnabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFA)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"mfa_token": token, "message": "a two-factor authentication code is required"}
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Failures are only forgotten once the user is fully signed in, so that someone who knows
+	// the password can't reset the count while guessing two-factor codes.
+	if input.MagicToken == "" {
+		app.clearLoginFailures(r, input.Email)
+	}
+
+	app.issueAuthenticationToken(w, r, user, input.Refresh)
+}
+
+// The issueAuthenticationToken() helper starts a new session for a user who has signed in, and
+// sends them its authentication token. Clients which ask for a refresh token get a short-lived
+// authentication token along with it, which they can renew at /v1/tokens/refresh.
+func (app *application) issueAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User, refresh bool) {
+	ttl, refreshTTL := app.config.tokens.authenticationTTL, time.Duration(0)
+	if refresh {
+		ttl, refreshTTL = app.config.tokens.accessTTL, app.config.tokens.refreshTTL
+	}
+
+	token, refreshToken, err := app.models.Tokens.NewSession(user.ID, ttl, refreshTTL, r.UserAgent(), realip.FromRequest(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	// In the jwt mode the stored authentication token is never given out. It keeps the
+	// session alive for as long as the JWT, so that the JWT can be revoked with it when
+	// -jwt-check-revocation is set.
+	if app.config.auth.mode == "jwt" {
+		token, err = app.newJWT(user.ID, user.Activated, ttl, token.FamilyID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.auditAs(r, user.ID, data.AuditTokenIssue, "user", user.ID, nil, map[string]any{"refresh": refresh})
+
+	env := envelope{"authentication_token": token}
+	if refreshToken != nil {
+		env["refresh_token"] = refreshToken
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The newJWT() helper signs a JWT for the user, embedding their current permissions. It is
+// returned as a data.Token, so that clients get the same response in both authentication modes.
+func (app *application) newJWT(userID int64, activated bool, ttl time.Duration, sessionID int64) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(ttl)
+
+	claims := jwt.Claims{
+		Issuer:      app.config.jwt.issuer,
+		Subject:     strconv.FormatInt(userID, 10),
+		IssuedAt:    now.Unix(),
+		NotBefore:   now.Unix(),
+		Expiry:      expiry.Unix(),
+		SessionID:   sessionID,
+		Activated:   activated,
+		Permissions: permissions,
+	}
+
+	signed, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{Plaintext: signed, Expiry: expiry, UserID: userID, Scope: data.ScopeAuthentication}, nil
+}
+
+// The jwksHandler() publishes the public keys which JWTs can be verified with, so that other
+// services can verify them without sharing a secret.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []jwt.JWK{}
+	if app.jwtKeys != nil {
+		keys = app.jwtKeys.JWKS()
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"keys": keys}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The refreshAuthenticationTokenHandler() exchanges a refresh token for a new authentication
+// token and refresh token. The refresh token can't be used again afterwards.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.RefreshToken != "", "refresh_token", "required")
+	v.Check(len(input.RefreshToken) == 26, "refresh_token", "exact-bytes", 26)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, refreshToken, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.logger.Warn("refresh token reused; session revoked", "ip", realip.FromRequest(r), "request_id", app.contextGetRequestID(r))
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.config.auth.mode == "jwt" {
+		// The JWT's claims have to be current, so the user is looked up again.
+		user, err := app.models.Users.Get(refreshToken.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err = app.newJWT(user.ID, user.Activated, app.config.tokens.accessTTL, refreshToken.FamilyID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.auditAs(r, refreshToken.UserID, data.AuditTokenRefresh, "user", refreshToken.UserID, nil, map[string]any{"session_id": refreshToken.FamilyID})
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createMagicLinkTokenHandler() emails a single-use magic token to the user, which signs
+// them in without a password. The response is the same whether or not there is a user with the
+// email address, and all of the work happens in the background so that the response time
+// doesn't give it away either.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Error(err.Error())
+			}
+			return
+		}
+
+		if user.ServiceAccount {
+			return
+		}
+
+		// Only the most recent magic link works.
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeMagicLink, user.ID)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		err = app.models.WithTx(func(tx *sql.Tx) error {
+			token, err := app.models.Tokens.NewTx(tx, user.ID, 15*time.Minute, data.ScopeMagicLink)
+			if err != nil {
+				return err
+			}
+
+			return app.models.Outbox.InsertTx(tx, &data.OutboxMessage{
+				Recipient: user.Email,
+				Template:  "token_magic_link.tmpl",
+				Locale:    user.Locale,
+				Data: map[string]any{
+					"magicToken": token.Plaintext,
+				},
+			})
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "if an account exists for this email address, you will receive an email containing a sign in link"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -84,7 +395,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
+			v.AddError("email", "email-not-found")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -92,31 +403,40 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	if !user.Activated {
-		v.AddError("email", "user account must be activated")
+	if user.ServiceAccount {
+		v.AddError("email", "email-not-found")
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	if !user.Activated {
+		v.AddError("email", "activation-required")
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Email the user with their password reset token
-	app.background(func() {
-		data := map[string]any{
-			"passwordResetToken": token.Plaintext,
+	err = app.models.WithTx(func(tx *sql.Tx) error {
+		token, err := app.models.Tokens.NewTx(tx, user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			return err
 		}
 
 		// Since emails may be case sensitive, notice that we are sending this
 		// email using the address stored in our database for the user --- not to the input.Email
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
+		return app.models.Outbox.InsertTx(tx, &data.OutboxMessage{
+			Recipient: user.Email,
+			Template:  "token_password_reset.tmpl",
+			Locale:    user.Locale,
+			Data: map[string]any{
+				"passwordResetToken": token.Plaintext,
+			},
+		})
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
@@ -146,7 +466,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
+			v.AddError("email", "email-not-found")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -155,28 +475,31 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	if user.Activated {
-		v.AddError("email", "user has already been activated")
+		v.AddError("email", "already-activated")
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	err = app.models.WithTx(func(tx *sql.Tx) error {
+		token, err := app.models.Tokens.NewTx(tx, user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		return app.models.Outbox.InsertTx(tx, &data.OutboxMessage{
+			Recipient: user.Email,
+			Template:  "token_activation.tmpl",
+			Locale:    user.Locale,
+			Data: map[string]any{
+				"activationToken": token.Plaintext,
+			},
+		})
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
-
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
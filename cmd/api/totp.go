@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"github.com/navarrovmn/internal/data"
+	"github.com/navarrovmn/internal/totp"
+	"github.com/navarrovmn/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The name which authenticator apps show next to the user's codes.
+const totpIssuer = "Greenlight"
+
+// The startTOTPEnrolmentHandler() creates a new TOTP secret for the user. Two-factor
+// authentication isn't enabled until the secret is confirmed with confirmTOTPHandler(), so that
+// a user who never finishes scanning the QR code isn't locked out.
+func (app *application) startTOTPEnrolmentHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ServiceAccount {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Password != "", "password", "required"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Start(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("totp", "totp-enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"totp": envelope{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmTOTPHandler() enables two-factor authentication once the user has sent a code from
+// their authenticator app, and returns their recovery codes. This is the only time that the
+// recovery codes are shown. Other sessions were signed in without a second factor, so they are
+// revoked.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "required"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "totp-not-started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Enabled() {
+		v.AddError("totp", "totp-enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	counter, ok := totp.Verify(t.Secret, input.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Confirm(user.ID, counter, recoveryCodes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllSessionsForUserExcept(user.ID, app.contextGetSessionID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTOTPEnable, "user", user.ID, nil, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The disableTOTPHandler() turns two-factor authentication off. It needs both the user's
+// password and a second factor.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Password != "", "password", "required")
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, ok := app.enabledTOTP(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	err = app.checkSecondFactor(v, t, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTOTPDisable, "user", user.ID, nil, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The regenerateRecoveryCodesHandler() replaces the user's recovery codes, for example when
+// they have used most of them up.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "required"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, ok := app.enabledTOTP(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	err = app.checkSecondFactor(v, t, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes(10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.RecoveryCodes.Replace(user.ID, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createMFAAuthenticationTokenHandler() is the second step of signing in for users with
+// two-factor authentication. It exchanges the mfa token from the first step, along with a TOTP
+// code or a recovery code, for an authentication token.
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		Refresh      bool   `json:"refresh"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.MFAToken != "", "mfa_token", "required")
+	v.Check(len(input.MFAToken) == 26, "mfa_token", "exact-bytes", 26)
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFA, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	t, ok := app.enabledTOTP(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	// Wrong codes count as failed attempts to sign in as the user, like wrong passwords. Once
+	// reserved, the attempt is released on every other way out of the handler.
+	attempt, retryAfter, err := app.reserveLoginAttempt(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.loginLockedResponse(w, r, retryAfter)
+		return
+	}
+
+	err = app.checkSecondFactor(v, t, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.releaseLoginAttempt(r, attempt)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.recordLoginFailure(r, attempt, user)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The mfa token is kept after a wrong code, so that the user can try again, but only one
+	// request can redeem it with a right one. The failures are only cleared once it has.
+	err = app.models.Tokens.Redeem(data.ScopeMFA, user.ID, input.MFAToken)
+	if err != nil {
+		app.releaseLoginAttempt(r, attempt)
+
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.releaseLoginAttempt(r, attempt)
+	app.clearLoginFailures(r, user.Email)
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFA, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user, input.Refresh)
+}
+
+// validateSecondFactor checks that exactly one of a TOTP code and a recovery code was given.
+func validateSecondFactor(v *validator.Validator, code, recoveryCode string) {
+	v.Check(code != "" || recoveryCode != "", "code", "required")
+	v.Check(code == "" || recoveryCode == "", "recovery_code", "conflicts-with-code")
+}
+
+// The enabledTOTP() helper returns the user's TOTP secret, provided that two-factor
+// authentication is enabled. Otherwise it sends an error response and returns false.
+func (app *application) enabledTOTP(w http.ResponseWriter, r *http.Request, userID int64) (*data.TOTP, bool) {
+	t, err := app.models.TOTP.Get(userID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if t == nil || !t.Enabled() {
+		v := validator.New()
+		v.AddError("totp", "totp-not-enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return t, true
+}
+
+// The checkSecondFactor() helper checks a TOTP code, or otherwise a recovery code. Each code is
+// only accepted once. A wrong code is added to the validator's errors, while the returned error
+// is for server errors only, so that callers can tell a failed attempt from a failed request.
+func (app *application) checkSecondFactor(v *validator.Validator, t *data.TOTP, code, recoveryCode string) error {
+	if code != "" {
+		counter, ok := totp.Verify(t.Secret, code, time.Now(), 1)
+		if !ok {
+			v.AddError("code", "invalid")
+			return nil
+		}
+
+		err := app.models.TOTP.UseCounter(t.UserID, counter)
+		if errors.Is(err, data.ErrTOTPCodeReused) {
+			v.AddError("code", "already-used")
+			return nil
+		}
+
+		return err
+	}
+
+	err := app.models.RecoveryCodes.Use(t.UserID, recoveryCode)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		v.AddError("recovery_code", "invalid")
+		return nil
+	}
+
+	return err
+}
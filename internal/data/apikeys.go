@@ -0,0 +1,287 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/navarrovmn/internal/validator"
+)
+
+// APIKeyPrefix starts every API key, so they can't be mistaken for authentication tokens,
+// and are easy to spot if they are leaked.
+const APIKeyPrefix = "glk_"
+
+var (
+	ErrDuplicateAPIKeyName = errors.New("duplicate api key name")
+)
+
+// An APIKey is a long-lived credential for a user, limited to a subset of their permissions.
+// The key itself is only known when it is created: after that, the prefix is all that is left
+// to recognise it by.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+func generateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Plaintext = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+8]
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "required")
+	v.Check(len(key.Name) <= 100, "name", "max-bytes", 100)
+
+	v.Check(len(key.Permissions) > 0, "permissions", "min-permissions")
+	v.Check(validator.Unique(key.Permissions), "permissions", "duplicate-values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "in-future")
+	}
+}
+
+// IsAPIKey reports whether a bearer token looks like an API key rather than a token.
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// New creates an API key for the user with the given permissions. The expiry is optional.
+func (m APIKeyModel) New(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(key)
+	return key, err
+}
+
+// NewTx creates an API key for the user as part of a transaction.
+func (m APIKeyModel) NewTx(tx *sql.Tx, userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertAPIKey(tx, key)
+	return key, err
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertAPIKey(tx, key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertAPIKey inserts the key and its permissions, which takes two statements, so it is always
+// run in a transaction.
+func insertAPIKey(tx *sql.Tx, key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "api_keys_user_id_name_key"`:
+			return ErrDuplicateAPIKeyName
+		default:
+			return err
+		}
+	}
+
+	query = `
+		INSERT INTO api_keys_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, key.ID, pq.Array(key.Permissions))
+	return err
+}
+
+// GetForKey returns the unexpired API key with the given plaintext. Its permissions aren't
+// loaded; use PermissionModel.GetAllForAPIKey for those.
+func (m APIKeyModel) GetForKey(plaintext string) (*APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT id, user_id, created_at, name, prefix, expiry, last_used_at
+		FROM api_keys
+		WHERE hash = $1
+		AND (expiry IS NULL OR expiry > $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		&key.Expiry,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+// GetAllForUser returns all of the user's API keys with their permissions, including keys which
+// have expired.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT api_keys.id, api_keys.user_id, api_keys.created_at, api_keys.name, api_keys.prefix,
+			api_keys.expiry, api_keys.last_used_at,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM api_keys
+		LEFT JOIN api_keys_permissions ON api_keys_permissions.api_key_id = api_keys.id
+		LEFT JOIN permissions ON api_keys_permissions.permission_id = permissions.id
+		WHERE api_keys.user_id = $1
+		GROUP BY api_keys.id
+		ORDER BY api_keys.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var (
+			key         APIKey
+			permissions []string
+		)
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.CreatedAt,
+			&key.Name,
+			&key.Prefix,
+			&key.Expiry,
+			&key.LastUsedAt,
+			pq.Array(&permissions),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Permissions = permissions
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Touch records that the API key was used just now.
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Delete revokes one of the user's API keys.
+func (m APIKeyModel) Delete(userID, id int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,376 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditMovieCreate      = "movie.create"
+	AuditMovieUpdate      = "movie.update"
+	AuditMovieDelete      = "movie.delete"
+	AuditMovieRestore     = "movie.restore"
+	AuditMovieImport      = "movie.import"
+	AuditTokenIssue       = "token.issue"
+	AuditTokenRefresh     = "token.refresh"
+	AuditTokenRevoke      = "token.revoke"
+	AuditLoginFailure     = "login.failure"
+	AuditLoginUnlock      = "login.unlock"
+	AuditAPIKeyCreate     = "api_key.create"
+	AuditAPIKeyDelete     = "api_key.delete"
+	AuditUserCreate       = "user.create"
+	AuditUserActivate     = "user.activate"
+	AuditUserUpdate       = "user.update"
+	AuditUserDelete       = "user.delete"
+	AuditPasswordReset    = "user.password_reset"
+	AuditPasswordChange   = "user.password_change"
+	AuditEmailChange      = "user.email_change"
+	AuditTOTPEnable       = "user.totp_enable"
+	AuditTOTPDisable      = "user.totp_disable"
+	AuditPermissionGrant  = "permission.grant"
+	AuditPermissionRevoke = "permission.revoke"
+	AuditRoleCreate       = "role.create"
+	AuditRoleUpdate       = "role.update"
+	AuditRoleDelete       = "role.delete"
+	AuditRoleAssign       = "role.assign"
+	AuditRoleUnassign     = "role.unassign"
+)
+
+// The key of the PostgreSQL advisory lock which is held while an event is added to the hash
+// chain, so that events are chained in the order of their IDs.
+const auditChainLockKey = 0x61756469
+
+// An AuditEvent records who did what to which record. Actor and target IDs are kept as plain
+// numbers, rather than foreign keys, so that events outlive the users and records they refer
+// to. The diff holds the fields which changed, each with its value before and after.
+//
+// When hash chaining is enabled, each event's hash covers its own fields and the hash of the
+// event before it, so an event which is changed or removed breaks the chain from that point on.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *int64          `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   *int64          `json:"target_id,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Diff       json.RawMessage `json:"diff,omitempty"`
+	PrevHash   []byte          `json:"prev_hash,omitempty"`
+	Hash       []byte          `json:"hash,omitempty"`
+}
+
+// An AuditChange is a changed field in the diff of an audit event. From is null for records
+// which were created, and To is null for records which were deleted.
+type AuditChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// AuditDiff compares the JSON representations of a record before and after a change, and
+// returns the fields which differ. Either of them can be nil. Fields which are left out of the
+// JSON representation, like password hashes, are never included.
+func AuditDiff(before, after any) (json.RawMessage, error) {
+	if before == nil && after == nil {
+		return nil, nil
+	}
+
+	from, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]AuditChange)
+
+	for key, value := range from {
+		if !reflect.DeepEqual(value, to[key]) {
+			changes[key] = AuditChange{From: value, To: to[key]}
+		}
+	}
+	for key, value := range to {
+		if _, ok := from[key]; !ok {
+			changes[key] = AuditChange{To: value}
+		}
+	}
+
+	return json.Marshal(changes)
+}
+
+func auditFields(v any) (map[string]any, error) {
+	fields := make(map[string]any)
+
+	if v == nil {
+		return fields, nil
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("audit diff of %T: %w", v, err)
+	}
+
+	return fields, nil
+}
+
+// computeHash returns the hash of the event for the hash chain. The diff is stored in a json
+// column, rather than jsonb, so that it comes back from the database byte for byte.
+func (e *AuditEvent) computeHash() []byte {
+	fields := struct {
+		CreatedAt  string `json:"created_at"`
+		ActorID    *int64 `json:"actor_id"`
+		Action     string `json:"action"`
+		TargetType string `json:"target_type"`
+		TargetID   *int64 `json:"target_id"`
+		IP         string `json:"ip"`
+		RequestID  string `json:"request_id"`
+		Diff       string `json:"diff"`
+	}{
+		CreatedAt:  e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ActorID:    e.ActorID,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		IP:         e.IP,
+		RequestID:  e.RequestID,
+		Diff:       string(e.Diff),
+	}
+
+	js, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+
+	h := sha256.New()
+	h.Write(e.PrevHash)
+	h.Write(js)
+
+	return h.Sum(nil)
+}
+
+// chainsFrom reports whether the event follows on in the hash chain from the event with the hash
+// prevHash, and hasn't been changed since it was added.
+func (e *AuditEvent) chainsFrom(prevHash []byte) bool {
+	return bytes.Equal(e.PrevHash, prevHash) && bytes.Equal(e.computeHash(), e.Hash)
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// Insert adds an event to the audit log, and to the hash chain if chain is true.
+func (m AuditModel) Insert(event *AuditEvent, chain bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertAuditEvent(tx, event, chain)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertTx adds an event to the audit log as part of a transaction, so that the event is only
+// recorded if the action it describes is committed. With chain set, the lock on the hash chain
+// is held until the transaction ends.
+func (m AuditModel) InsertTx(tx *sql.Tx, event *AuditEvent, chain bool) error {
+	return insertAuditEvent(tx, event, chain)
+}
+
+// insertAuditEvent needs a transaction even for a single event, to hold the lock on the hash
+// chain between reading the last hash and inserting the new one.
+func insertAuditEvent(tx *sql.Tx, event *AuditEvent, chain bool) error {
+	// PostgreSQL keeps timestamps to the microsecond, so the time is rounded to match before
+	// it is hashed.
+	event.CreatedAt = time.Now().Truncate(time.Microsecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if chain {
+		_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, auditChainLockKey)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			SELECT hash
+			FROM audit_events
+			WHERE hash IS NOT NULL
+			ORDER BY id DESC
+			LIMIT 1`
+
+		err = tx.QueryRowContext(ctx, query).Scan(&event.PrevHash)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		event.Hash = event.computeHash()
+	}
+
+	query := `
+		INSERT INTO audit_events (created_at, actor_id, action, target_type, target_id, ip, request_id, diff, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id`
+
+	// A []byte argument would be sent as bytea, so the diff is passed as a string.
+	var diff any
+	if event.Diff != nil {
+		diff = string(event.Diff)
+	}
+
+	args := []any{event.CreatedAt, event.ActorID, event.Action, event.TargetType, event.TargetID, event.IP, event.RequestID, diff, event.PrevHash, event.Hash}
+
+	return tx.QueryRowContext(ctx, query, args...).Scan(&event.ID)
+}
+
+// GetAll returns a page of audit events. Filters with zero values are ignored.
+func (m AuditModel) GetAll(actorID int64, action, targetType string, targetID int64, since, until *time.Time, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, actor_id, action, target_type, target_id, ip, request_id, diff, prev_hash, hash
+		FROM audit_events
+		WHERE (actor_id = $1 OR $1 = 0)
+		AND (action = $2 OR $2 = '')
+		AND (target_type = $3 OR $3 = '')
+		AND (target_id = $4 OR $4 = 0)
+		AND (created_at >= $5 OR $5 IS NULL)
+		AND (created_at < $6 OR $6 IS NULL)
+		ORDER BY %s %s
+		LIMIT $7 OFFSET $8`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{actorID, action, targetType, targetID, since, until, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err := scanAuditEvent(rows, &totalRecords, &event)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
+
+// Verify checks the hash chain from the start. It returns the number of events which were
+// checked, and the ID of the first event which doesn't match the chain, or 0 if they all do.
+func (m AuditModel) Verify() (int, int64, error) {
+	query := `
+		SELECT id, created_at, actor_id, action, target_type, target_id, ip, request_id, diff, prev_hash, hash
+		FROM audit_events
+		WHERE hash IS NOT NULL
+		ORDER BY id`
+
+	// The whole log is read, so allow it more time than a single record operation.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	checked := 0
+	var prevHash []byte
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err := scanAuditEvent(rows, nil, &event)
+		if err != nil {
+			return checked, 0, err
+		}
+
+		checked++
+
+		if !event.chainsFrom(prevHash) {
+			return checked, event.ID, nil
+		}
+
+		prevHash = event.Hash
+	}
+
+	if err = rows.Err(); err != nil {
+		return checked, 0, err
+	}
+
+	return checked, 0, nil
+}
+
+// scanAuditEvent scans a row of audit event columns, preceded by the total record count when
+// totalRecords isn't nil.
+func scanAuditEvent(rows *sql.Rows, totalRecords *int, event *AuditEvent) error {
+	var diff []byte
+
+	dest := []any{
+		&event.ID,
+		&event.CreatedAt,
+		&event.ActorID,
+		&event.Action,
+		&event.TargetType,
+		&event.TargetID,
+		&event.IP,
+		&event.RequestID,
+		&diff,
+		&event.PrevHash,
+		&event.Hash,
+	}
+	if totalRecords != nil {
+		dest = append([]any{totalRecords}, dest...)
+	}
+
+	err := rows.Scan(dest...)
+	if err != nil {
+		return err
+	}
+
+	if diff != nil {
+		event.Diff = diff
+	}
+
+	return nil
+}
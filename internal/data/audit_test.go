@@ -0,0 +1,196 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newAuditChain returns events chained in the way AuditModel.Insert() chains them.
+func newAuditChain(t *testing.T) []*AuditEvent {
+	t.Helper()
+
+	actorID, targetID := int64(1), int64(42)
+	createdAt := time.Date(2024, 3, 1, 12, 0, 0, 123456000, time.UTC)
+
+	diff, err := AuditDiff(map[string]any{"title": "Moana"}, map[string]any{"title": "Moana 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []*AuditEvent{
+		{ID: 1, CreatedAt: createdAt, ActorID: &actorID, Action: AuditMovieCreate, TargetType: "movie", TargetID: &targetID, IP: "203.0.113.7", RequestID: "a"},
+		{ID: 2, CreatedAt: createdAt.Add(time.Second), ActorID: &actorID, Action: AuditMovieUpdate, TargetType: "movie", TargetID: &targetID, IP: "203.0.113.7", RequestID: "b", Diff: diff},
+		{ID: 3, CreatedAt: createdAt.Add(2 * time.Second), Action: AuditLoginFailure, TargetType: "user", IP: "198.51.100.1"},
+	}
+
+	var prevHash []byte
+	for _, event := range events {
+		event.PrevHash = prevHash
+		event.Hash = event.computeHash()
+		prevHash = event.Hash
+	}
+
+	return events
+}
+
+// verifyChain checks the events in the way AuditModel.Verify() does, and returns the ID of the
+// first one which doesn't match the chain, or 0.
+func verifyChain(events []*AuditEvent) int64 {
+	var prevHash []byte
+
+	for _, event := range events {
+		if !event.chainsFrom(prevHash) {
+			return event.ID
+		}
+		prevHash = event.Hash
+	}
+
+	return 0
+}
+
+func TestComputeHash(t *testing.T) {
+	events := newAuditChain(t)
+
+	if len(events[0].Hash) != 32 {
+		t.Fatalf("hash is %d bytes long; want 32", len(events[0].Hash))
+	}
+
+	// The hash is deterministic, and doesn't depend on the time zone of the timestamp.
+	event := *events[1]
+	event.CreatedAt = event.CreatedAt.In(time.FixedZone("BRT", -3*60*60))
+	if !bytes.Equal(event.computeHash(), events[1].Hash) {
+		t.Error("computeHash() changed with the time zone")
+	}
+
+	// Events with the same fields have different hashes in different places in the chain.
+	event = *events[1]
+	event.PrevHash = nil
+	if bytes.Equal(event.computeHash(), events[1].Hash) {
+		t.Error("computeHash() doesn't depend on the previous hash")
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	otherID := int64(2)
+
+	tests := []struct {
+		name   string
+		tamper func(events []*AuditEvent) []*AuditEvent
+		want   int64
+	}{
+		{
+			name:   "intact",
+			tamper: func(events []*AuditEvent) []*AuditEvent { return events },
+			want:   0,
+		},
+		{
+			name: "action changed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[1].Action = AuditMovieDelete
+				return events
+			},
+			want: 2,
+		},
+		{
+			name: "actor changed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[0].ActorID = &otherID
+				return events
+			},
+			want: 1,
+		},
+		{
+			name: "actor removed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[1].ActorID = nil
+				return events
+			},
+			want: 2,
+		},
+		{
+			name: "diff changed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[1].Diff = json.RawMessage(`{"title":{"from":"Moana","to":"Frozen"}}`)
+				return events
+			},
+			want: 2,
+		},
+		{
+			name: "time changed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[2].CreatedAt = events[2].CreatedAt.Add(time.Microsecond)
+				return events
+			},
+			want: 3,
+		},
+		{
+			name: "event removed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				return append(events[:1], events[2:]...)
+			},
+			want: 3,
+		},
+		{
+			name: "events swapped",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[1], events[2] = events[2], events[1]
+				return events
+			},
+			want: 3,
+		},
+		{
+			name: "event changed and rehashed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				events[1].IP = "192.0.2.1"
+				events[1].Hash = events[1].computeHash()
+				return events
+			},
+			want: 3,
+		},
+		{
+			name: "first event removed",
+			tamper: func(events []*AuditEvent) []*AuditEvent {
+				return events[1:]
+			},
+			want: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyChain(tt.tamper(newAuditChain(t))); got != tt.want {
+				t.Errorf("first broken event = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		before any
+		after  any
+		want   string
+	}{
+		{name: "nothing", before: nil, after: nil, want: ""},
+		{name: "created", before: nil, after: map[string]any{"title": "Moana"}, want: `{"title":{"from":null,"to":"Moana"}}`},
+		{name: "deleted", before: map[string]any{"title": "Moana"}, after: nil, want: `{"title":{"from":"Moana","to":null}}`},
+		{name: "changed", before: map[string]any{"title": "Moana", "year": 2016}, after: map[string]any{"title": "Moana 2", "year": 2016}, want: `{"title":{"from":"Moana","to":"Moana 2"}}`},
+		{name: "unchanged", before: map[string]any{"year": 2016}, after: map[string]any{"year": 2016}, want: `{}`},
+		{name: "password hash left out", before: &User{Name: "Alice"}, after: &User{Name: "Alice", Password: password{hash: []byte("x")}}, want: `{}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AuditDiff(tt.before, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AuditDiff() = %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/navarrovmn/internal/validator"
+)
+
+var (
+	ErrDuplicateCredit = errors.New("duplicate credit")
+)
+
+// The roles a person can be credited with on a movie.
+var CreditRoles = []string{"director", "writer", "producer", "actor", "composer", "cinematographer", "editor"}
+
+// A Credit links a person to a movie in a role. Billing order determines the order in which the
+// credits of a movie are listed. Depending on how the credit was fetched, either the Person or
+// the Movie field is populated.
+type Credit struct {
+	ID           int64   `json:"id"`
+	MovieID      int64   `json:"movie_id"`
+	PersonID     int64   `json:"person_id"`
+	Role         string  `json:"role"`
+	Character    string  `json:"character,omitempty"`
+	BillingOrder int32   `json:"billing_order"`
+	Person       *Person `json:"person,omitempty"`
+	Movie        *Movie  `json:"movie,omitempty"`
+}
+
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID > 0, "person_id", "required")
+	v.Check(credit.Role != "", "role", "required")
+	v.Check(validator.PermittedValue(credit.Role, CreditRoles...), "role", "invalid-value")
+	v.Check(credit.Character == "" || credit.Role == "actor", "character", "actors-only")
+	v.Check(len(credit.Character) <= 500, "character", "max-bytes", 500)
+	v.Check(credit.BillingOrder >= 0, "billing_order", "not-negative")
+}
+
+type CreditModel struct {
+	DB *sql.DB
+}
+
+func (m CreditModel) Insert(credit *Credit) error {
+	query := `
+		INSERT INTO movie_credits (movie_id, person_id, role, character, billing_order)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{credit.MovieID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "movie_credits_movie_id_person_id_role_character_key"`:
+			return ErrDuplicateCredit
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForMovie() returns the credits of the movie in billing order, with the credited people.
+func (m CreditModel) GetAllForMovie(movieID int64) ([]*Credit, error) {
+	query := `
+		SELECT movie_credits.id, movie_credits.movie_id, movie_credits.person_id, movie_credits.role,
+			movie_credits.character, movie_credits.billing_order,
+			people.id, people.created_at, people.name, people.biography, people.version
+		FROM movie_credits
+		INNER JOIN people ON people.id = movie_credits.person_id
+		WHERE movie_credits.movie_id = $1
+		ORDER BY movie_credits.billing_order ASC, movie_credits.id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := []*Credit{}
+
+	for rows.Next() {
+		credit := Credit{Person: &Person{}}
+
+		err := rows.Scan(
+			&credit.ID,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+			&credit.Person.ID,
+			&credit.Person.CreatedAt,
+			&credit.Person.Name,
+			&credit.Person.Biography,
+			&credit.Person.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// GetAllForPerson() returns the person's filmography: their credits with the credited movies.
+// Movies in the trash are left out.
+func (m CreditModel) GetAllForPerson(personID int64, filters Filters) ([]*Credit, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), movie_credits.id, movie_credits.movie_id, movie_credits.person_id,
+			movie_credits.role, movie_credits.character, movie_credits.billing_order,
+			movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.version, movies.rating, movies.review_count
+		FROM movie_credits
+		INNER JOIN movies ON movies.id = movie_credits.movie_id
+		WHERE movie_credits.person_id = $1
+		AND movies.deleted_at IS NULL
+		ORDER BY %s %s, movie_credits.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, personID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	credits := []*Credit{}
+
+	for rows.Next() {
+		credit := Credit{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&credit.ID,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+			&credit.Movie.ID,
+			&credit.Movie.CreatedAt,
+			&credit.Movie.Title,
+			&credit.Movie.Year,
+			&credit.Movie.Runtime,
+			pq.Array(&credit.Movie.Genres),
+			&credit.Movie.Version,
+			&credit.Movie.Rating,
+			&credit.Movie.ReviewCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return credits, metadata, nil
+}
+
+func (m CreditModel) Delete(movieID, creditID int64) error {
+	query := `
+		DELETE FROM movie_credits
+		WHERE id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, creditID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -1,17 +1,24 @@
 package data
 
 import (
-	"github.com/navarrovmn/internal/validator"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
 	"strings"
+
+	"github.com/navarrovmn/internal/validator"
 )
 
 // Define a new Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	Cursor       string `json:"cursor,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -28,21 +35,55 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 	}
 }
 
+// The Filters struct supports two pagination modes. In page-number mode (the default)
+// Page and PageSize are used to build a LIMIT/OFFSET clause. In cursor mode, which is
+// enabled by setting CursorMode, the opaque Cursor returned in a previous response's
+// metadata is used to continue from the last record seen, and Page is ignored.
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	Cursor       string
+	CursorMode   bool
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	v.Check(f.Page > 0, "page", "must be greater than 0")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than 0")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(f.Page > 0, "page", "greater-than", 0)
+	v.Check(f.Page <= 10_000_000, "page", "max-value", 10_000_000)
+	v.Check(f.PageSize > 0, "page_size", "greater-than", 0)
+	v.Check(f.PageSize <= 100, "page_size", "max-value", 100)
 
 	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid-value")
+
+	// A cursor is only meaningful for the sort order it was generated with, so reject
+	// cursors which can't be decoded or which were issued for a different sort. The value
+	// is sent to PostgreSQL as it is, so it also has to parse as the sort column's type.
+	if f.CursorMode && f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil, "cursor", "invalid-cursor")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "cursor-sort-mismatch")
+		v.Check(err != nil || validCursorValue(strings.TrimPrefix(c.Sort, "-"), c.Value), "cursor", "invalid-cursor")
+	}
+}
+
+// The validCursorValue() function reports whether a cursor's sort value can be compared with
+// the column. Text columns accept any value.
+func validCursorValue(column, value string) bool {
+	switch column {
+	case "id":
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case "year", "runtime":
+		_, err := strconv.ParseInt(value, 10, 32)
+		return err == nil
+	case "rating":
+		n, err := strconv.ParseFloat(value, 64)
+		return err == nil && !math.IsNaN(n) && !math.IsInf(n, 0)
+	}
+
+	return true
 }
 
 // Check that the client-provided Sort field matches one of the entries in the safelist
@@ -72,3 +113,45 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
+// The keysetOperator() returns the comparison operator used to select the records
+// which come after the cursor position for the current sort direction.
+func (f Filters) keysetOperator() string {
+	if f.sortDirection() == "DESC" {
+		return "<"
+	}
+
+	return ">"
+}
+
+// The cursor struct holds the position of the last record on a page: the value of
+// the sort column and the record ID, which is used as a tie-breaker. The sort value is
+// kept as a string and compared against the column by PostgreSQL, which infers the
+// parameter type from the column type.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+}
+
+// The encodeCursor() function serializes a cursor into an opaque URL-safe string.
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(js, &c)
+	return c, err
+}
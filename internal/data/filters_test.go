@@ -0,0 +1,143 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/navarrovmn/internal/validator"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor cursor
+	}{
+		{name: "id", cursor: cursor{Sort: "id", Value: "42", ID: 42}},
+		{name: "descending title", cursor: cursor{Sort: "-title", Value: "The Breakfast Club", ID: 7}},
+		{name: "unicode and quotes", cursor: cursor{Sort: "title", Value: `Amélie "Le Fabuleux Destin"`, ID: 3}},
+		{name: "empty value", cursor: cursor{Sort: "year", Value: "", ID: 1}},
+		{name: "large id", cursor: cursor{Sort: "id", Value: "9223372036854775807", ID: 9223372036854775807}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encodeCursor(tt.cursor)
+
+			for _, c := range encoded {
+				if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+					t.Fatalf("encodeCursor() = %q, which isn't URL safe", encoded)
+				}
+			}
+
+			decoded, err := decodeCursor(encoded)
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+
+			if decoded != tt.cursor {
+				t.Errorf("decodeCursor() = %+v; want %+v", decoded, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "not base64", cursor: "not a cursor!"},
+		{name: "padded base64", cursor: "eyJzIjoiaWQifQ=="},
+		{name: "not JSON", cursor: "bm90IGpzb24"},
+		{name: "wrong type", cursor: "eyJpIjoiNDIifQ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeCursor(tt.cursor)
+			if err == nil {
+				t.Errorf("decodeCursor(%q) error = nil; want an error", tt.cursor)
+			}
+		})
+	}
+}
+
+func TestValidateFiltersCursor(t *testing.T) {
+	safelist := []string{"id", "title", "year", "rating", "-id", "-title", "-year", "-rating"}
+
+	tests := []struct {
+		name       string
+		sort       string
+		cursor     string
+		cursorMode bool
+		wantCode   string
+	}{
+		{name: "no cursor", sort: "id", cursorMode: true},
+		{name: "matching cursor", sort: "-title", cursor: encodeCursor(cursor{Sort: "-title", Value: "Moana", ID: 1}), cursorMode: true},
+		{name: "other sort", sort: "title", cursor: encodeCursor(cursor{Sort: "-title", Value: "Moana", ID: 1}), cursorMode: true, wantCode: "cursor-sort-mismatch"},
+		{name: "invalid cursor", sort: "id", cursor: "not a cursor!", cursorMode: true, wantCode: "invalid-cursor"},
+		{name: "ignored in page mode", sort: "id", cursor: "not a cursor!", cursorMode: false},
+		{name: "numeric value", sort: "-year", cursor: encodeCursor(cursor{Sort: "-year", Value: "1994", ID: 1}), cursorMode: true},
+		{name: "decimal value", sort: "rating", cursor: encodeCursor(cursor{Sort: "rating", Value: "7.50", ID: 1}), cursorMode: true},
+		{name: "text for a number", sort: "year", cursor: encodeCursor(cursor{Sort: "year", Value: "Moana", ID: 1}), cursorMode: true, wantCode: "invalid-cursor"},
+		{name: "out of range", sort: "year", cursor: encodeCursor(cursor{Sort: "year", Value: "99999999999", ID: 1}), cursorMode: true, wantCode: "invalid-cursor"},
+		{name: "empty number", sort: "-id", cursor: encodeCursor(cursor{Sort: "-id", Value: "", ID: 1}), cursorMode: true, wantCode: "invalid-cursor"},
+		{name: "not a number", sort: "rating", cursor: encodeCursor(cursor{Sort: "rating", Value: "NaN", ID: 1}), cursorMode: true, wantCode: "invalid-cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateFilters(v, Filters{
+				Page:         1,
+				PageSize:     20,
+				Sort:         tt.sort,
+				SortSafelist: safelist,
+				Cursor:       tt.cursor,
+				CursorMode:   tt.cursorMode,
+			})
+
+			if got := v.Errors["cursor"].Code; got != tt.wantCode {
+				t.Errorf("cursor error = %q; want %q", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFiltersSort(t *testing.T) {
+	tests := []struct {
+		sort          string
+		wantColumn    string
+		wantDirection string
+		wantOperator  string
+	}{
+		{sort: "id", wantColumn: "id", wantDirection: "ASC", wantOperator: ">"},
+		{sort: "-id", wantColumn: "id", wantDirection: "DESC", wantOperator: "<"},
+		{sort: "-title", wantColumn: "title", wantDirection: "DESC", wantOperator: "<"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			f := Filters{Sort: tt.sort, SortSafelist: []string{"id", "-id", "-title"}}
+
+			if got := f.sortColumn(); got != tt.wantColumn {
+				t.Errorf("sortColumn() = %q; want %q", got, tt.wantColumn)
+			}
+			if got := f.sortDirection(); got != tt.wantDirection {
+				t.Errorf("sortDirection() = %q; want %q", got, tt.wantDirection)
+			}
+			if got := f.keysetOperator(); got != tt.wantOperator {
+				t.Errorf("keysetOperator() = %q; want %q", got, tt.wantOperator)
+			}
+		})
+	}
+}
+
+func TestSortColumnUnsafe(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("sortColumn() didn't panic for a sort which isn't in the safelist")
+		}
+	}()
+
+	Filters{Sort: "id; DROP TABLE movies", SortSafelist: []string{"id"}}.sortColumn()
+}
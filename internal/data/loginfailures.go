@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A LoginFailure counts the recent failed sign in attempts for a key, which identifies either
+// an email address or an IP address.
+type LoginFailure struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// LoginFailureKeyForEmail returns the key for failed attempts to sign in as the email address.
+// Email addresses are case insensitive, so the key is too.
+func LoginFailureKeyForEmail(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+// LoginFailureKeyForIP returns the key for failed sign in attempts from the IP address.
+func LoginFailureKeyForIP(ip string) string {
+	return "ip:" + ip
+}
+
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUpdateTx returns the failures for the keys as part of a transaction, and locks them
+// until it ends, so that the count can't change between checking it and recording an attempt.
+// Keys without any failures get a row with none, so that they are locked too.
+func (m LoginFailureModel) GetAllForUpdateTx(tx *sql.Tx, keys ...string) ([]*LoginFailure, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		SELECT key, 0, NOW()
+		FROM unnest($1::text[]) AS key
+		ON CONFLICT (key) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows are locked in the same order by every transaction, so that two of them can't
+	// each wait for a row which the other has locked.
+	query = `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM login_failures
+		WHERE key = ANY($1)
+		ORDER BY key
+		FOR UPDATE`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := []*LoginFailure{}
+
+	for rows.Next() {
+		var failure LoginFailure
+
+		err := rows.Scan(
+			&failure.Key,
+			&failure.Failures,
+			&failure.LastFailureAt,
+			&failure.LockedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		failures = append(failures, &failure)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+// RecordTx counts a failed attempt for the key as part of a transaction, and returns the number
+// of failures so far. The count starts again from one if the last failure was longer ago than
+// the window.
+func (m LoginFailureModel) RecordTx(tx *sql.Tx, key string, window time.Duration) (int, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN login_failures.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := tx.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&failures)
+	return failures, err
+}
+
+// Release takes back an attempt which was counted for each of the keys before it was made, once
+// it turns out not to have failed.
+func (m LoginFailureModel) Release(keys ...string) error {
+	query := `
+		UPDATE login_failures
+		SET failures = GREATEST(failures - 1, 0)
+		WHERE key = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(keys))
+	return err
+}
+
+// Lock stops the key from being used to sign in until the given time.
+func (m LoginFailureModel) Lock(key string, until time.Time) error {
+	query := `
+		UPDATE login_failures
+		SET locked_until = $2
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, until)
+	return err
+}
+
+// Clear forgets the failures for the key, which also lifts any lockout. It reports whether
+// there were any failures to forget.
+func (m LoginFailureModel) Clear(key string) (bool, error) {
+	query := `
+		DELETE FROM login_failures
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, key)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
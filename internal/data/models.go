@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,20 +12,78 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// A querier runs queries on either a *sql.DB or a *sql.Tx. Queries which can be part of a
+// larger transaction are written once against it, and have a method for each case, such as
+// Insert() and InsertTx().
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // Models creates a wrapper that will have lots of models
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	db *sql.DB
+
+	APIKeys       APIKeyModel
+	Audit         AuditModel
+	Credits       CreditModel
+	LoginFailures LoginFailureModel
+	Movies        MovieModel
+	Outbox        OutboxModel
+	People        PersonModel
+	Permissions   PermissionModel
+	RecoveryCodes RecoveryCodeModel
+	Reviews       ReviewModel
+	Revisions     RevisionModel
+	Roles         RoleModel
+	TOTP          TOTPModel
+	Tokens        TokenModel
+	Users         UserModel
+	Watched       WatchedModel
+	Watchlist     WatchlistModel
 }
 
 // NewModels for ease of us which returns Model struct containing the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		db:            db,
+		APIKeys:       APIKeyModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Credits:       CreditModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Outbox:        OutboxModel{DB: db},
+		People:        PersonModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		RecoveryCodes: RecoveryCodeModel{DB: db},
+		Reviews:       ReviewModel{DB: db},
+		Revisions:     RevisionModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Users:         UserModel{DB: db},
+		Watched:       WatchedModel{DB: db},
+		Watchlist:     WatchlistModel{DB: db},
+	}
+}
+
+// WithTx runs fn in a transaction, which is committed if fn returns nil and rolled back if it
+// returns an error. The error is returned as it is, so callers can check for the models' errors.
+func (m Models) WithTx(fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
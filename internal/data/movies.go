@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/lib/pq"
@@ -12,27 +13,30 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`                // Unique integer ID for the movie
-	CreatedAt time.Time `json:"-"`                 // Timestamp for when it's added to the DB
-	Title     string    `json:"title"`             // Movie title
-	Year      int32     `json:"year,omitempty"`    // Movie release year
-	Runtime   Runtime   `json:"runtime,omitempty"` // Runtime in minutes
-	Genres    []string  `json:"genres,omitempty"`  // Slices of genres for the movie
-	Version   int32     `json:"version"`           // Version number starts at 1 and will be incremented whenever movie is updated
+	ID          int64      `json:"id"`                   // Unique integer ID for the movie
+	CreatedAt   time.Time  `json:"-"`                    // Timestamp for when it's added to the DB
+	Title       string     `json:"title"`                // Movie title
+	Year        int32      `json:"year,omitempty"`       // Movie release year
+	Runtime     Runtime    `json:"runtime,omitempty"`    // Runtime in minutes
+	Genres      []string   `json:"genres,omitempty"`     // Slices of genres for the movie
+	Version     int32      `json:"version"`              // Version number starts at 1 and will be incremented whenever movie is updated
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // Timestamp for when the movie was moved to the trash
+	Rating      float64    `json:"rating"`               // Average rating of the movie's reviews, or 0 if it hasn't been reviewed
+	ReviewCount int32      `json:"review_count"`         // Number of reviews of the movie
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
-	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
-	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.Check(movie.Title != "", "title", "required")
+	v.Check(len(movie.Title) <= 500, "title", "max-bytes", 500)
+	v.Check(movie.Year != 0, "year", "required")
+	v.Check(movie.Year >= 1888, "year", "greater-than", 1888)
+	v.Check(movie.Year <= int32(time.Now().Year()), "year", "not-in-future")
+	v.Check(movie.Runtime != 0, "runtime", "required")
+	v.Check(movie.Runtime > 0, "runtime", "positive-integer")
+	v.Check(movie.Genres != nil, "genres", "required")
+	v.Check(len(movie.Genres) >= 1, "genres", "min-genres")
+	v.Check(len(movie.Genres) <= 5, "genres", "max-genres", 5)
+	v.Check(validator.Unique(movie.Genres), "genres", "duplicate-values")
 }
 
 type MovieModel struct {
@@ -40,7 +44,8 @@ type MovieModel struct {
 }
 
 // Insert method accepts a pointer to a Movie struct which should contain the data for the movie.
-func (m MovieModel) Insert(movie *Movie) error {
+// The userID of the acting user is recorded in the movie's first revision.
+func (m MovieModel) Insert(movie *Movie, userID int64) error {
 	query := `
 		INSERT INTO movies (title, year, runtime, genres)
 		VALUES ($1, $2, $3, $4)
@@ -52,9 +57,102 @@ func (m MovieModel) Insert(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	// Begin a transaction so that the movie and its revision are written together.
+	// The deferred Rollback() is a no-op once the transaction has been committed.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return err
+	}
+
+	err = insertRevision(ctx, tx, movie, RevisionActionCreate, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertMany method inserts a batch of movies and their first revisions in a single transaction,
+// so either all of the movies are created or none are. The rows are loaded with COPY, which is
+// much faster than individual INSERT statements for large batches. Because COPY can't return
+// the generated IDs, they are reserved from the movies sequence up front.
+func (m MovieModel) InsertMany(movies []*Movie, userID int64) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	// Loading a large batch takes longer than a single record operation.
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT nextval(pg_get_serial_sequence('movies', 'id')), NOW()
+		FROM generate_series(1, $1)
+	`
+
+	rows, err := tx.QueryContext(ctx, query, len(movies))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; rows.Next(); i++ {
+		err = rows.Scan(&movies[i].ID, &movies[i].CreatedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		movies[i].Version = 1
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("movies", "id", "created_at", "title", "year", "runtime", "genres"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, movie := range movies {
+		_, err = stmt.ExecContext(ctx, movie.ID, movie.CreatedAt, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Calling Exec() with no arguments flushes the buffered rows to the database.
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = stmt.Close(); err != nil {
+		return err
+	}
+
+	err = copyRevisions(ctx, tx, movies, RevisionActionCreate, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
@@ -65,9 +163,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	query := `
-		SELECT  id, created_at, title, year, runtime, genres, version
+		SELECT  id, created_at, title, year, runtime, genres, version, rating, review_count
 		FROM movies
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	// Declare a movie struct to hold the data returned by the query
@@ -90,6 +188,8 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.Rating,
+		&movie.ReviewCount,
 	)
 
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -107,21 +207,27 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// GetAll() returns a slice of movies
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// GetAll() returns a slice of movies. If personID isn't zero, only the movies crediting that person are returned.
+func (m MovieModel) GetAll(title string, genres []string, personID int64, filters Filters) ([]*Movie, Metadata, error) {
+	if filters.CursorMode {
+		return m.getAllAfterCursor(title, genres, personID, filters)
+	}
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, rating, review_count
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
+		AND (id IN (SELECT movie_id FROM movie_credits WHERE person_id = $3) OR $3 = 0)
+		AND deleted_at IS NULL
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
 
 	// Timeout context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{title, pq.Array(genres), personID, filters.limit(), filters.offset()}
 	// Use QueryContext() to execute the query. This returns a sql.Rows result set.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -145,6 +251,8 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.Rating,
+			&movie.ReviewCount,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -163,12 +271,202 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// The getAllAfterCursor() method is the keyset pagination counterpart of GetAll(). Instead
+// of skipping rows with OFFSET it selects the rows which sort after the cursor position,
+// so it stays fast on deep pages and doesn't return duplicate or skipped rows when movies
+// are inserted while a client is paging. It doesn't count the total number of records.
+func (m MovieModel) getAllAfterCursor(title string, genres []string, personID int64, filters Filters) ([]*Movie, Metadata, error) {
+	column := filters.sortColumn()
+
+	args := []any{title, pq.Array(genres), personID, filters.limit() + 1}
+	keyset := ""
+
+	if filters.Cursor != "" {
+		c, err := decodeCursor(filters.Cursor)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		// The records are ordered by the sort column and then by id ASC, so the next
+		// page starts with the rows that sort after the cursor value, or which share
+		// the cursor value but have a greater id.
+		keyset = fmt.Sprintf("AND (%[1]s %[2]s $5 OR (%[1]s = $5 AND id > $6))", column, filters.keysetOperator())
+		args = append(args, c.Value, c.ID)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, created_at, title, year, runtime, genres, version, rating, review_count
+		FROM movies
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (genres @> $2 OR $2 = '{}')
+		AND (id IN (SELECT movie_id FROM movie_credits WHERE person_id = $3) OR $3 = 0)
+		AND deleted_at IS NULL
+		%s
+		ORDER BY %s %s, id ASC
+		LIMIT $4`, keyset, column, filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.Rating,
+			&movie.ReviewCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := Metadata{
+		PageSize: filters.PageSize,
+		Cursor:   filters.Cursor,
+	}
+
+	// We fetched one record more than the page size. If it's there, there is another
+	// page, and the cursor for it points at the last record we're going to return.
+	if len(movies) > filters.PageSize {
+		movies = movies[:filters.PageSize]
+		last := movies[len(movies)-1]
+
+		value, err := last.sortValue(column)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		metadata.NextCursor = encodeCursor(cursor{
+			Sort:  filters.Sort,
+			Value: value,
+			ID:    last.ID,
+		})
+	}
+
+	return movies, metadata, nil
+}
+
+// The sortValue() method returns the value of the given sort column for the movie,
+// formatted as a string for use in a pagination cursor. A sort column which it doesn't
+// know about is an error, rather than a panic in the middle of a request.
+func (movie *Movie) sortValue(column string) (string, error) {
+	switch column {
+	case "id":
+		return strconv.FormatInt(movie.ID, 10), nil
+	case "title":
+		return movie.Title, nil
+	case "year":
+		return strconv.FormatInt(int64(movie.Year), 10), nil
+	case "runtime":
+		return strconv.FormatInt(int64(movie.Runtime), 10), nil
+	case "rating":
+		return strconv.FormatFloat(movie.Rating, 'f', 2, 64), nil
+	}
+
+	return "", fmt.Errorf("unsupported cursor column: %s", column)
+}
+
+// Export() calls fn for every movie matching the title and genres filters, in ID order. Unlike
+// GetAll() it doesn't build a slice of the results: the movies are read from a server-side
+// cursor in fixed-size batches, so memory use stays flat however large the catalogue is. The
+// export runs until it completes, fn returns an error, or ctx is cancelled.
+func (m MovieModel) Export(ctx context.Context, title string, genres []string, fn func(*Movie) error) error {
+	// Cursors only exist inside a transaction. A read-only transaction also gives us a
+	// consistent snapshot of the catalogue for the duration of the export.
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DECLARE movies_export NO SCROLL CURSOR FOR
+		SELECT id, created_at, title, year, runtime, genres, version, rating, review_count
+		FROM movies
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (genres @> $2 OR $2 = '{}')
+		AND deleted_at IS NULL
+		ORDER BY id ASC`
+
+	_, err = tx.ExecContext(ctx, query, title, pq.Array(genres))
+	if err != nil {
+		return err
+	}
+
+	for {
+		rows, err := tx.QueryContext(ctx, "FETCH FORWARD 500 FROM movies_export")
+		if err != nil {
+			return err
+		}
+
+		fetched := 0
+
+		for rows.Next() {
+			var movie Movie
+
+			err := rows.Scan(
+				&movie.ID,
+				&movie.CreatedAt,
+				&movie.Title,
+				&movie.Year,
+				&movie.Runtime,
+				pq.Array(&movie.Genres),
+				&movie.Version,
+				&movie.Rating,
+				&movie.ReviewCount,
+			)
+			if err == nil {
+				err = fn(&movie)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			fetched++
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// An empty batch means the cursor is exhausted.
+		if fetched == 0 {
+			return nil
+		}
+	}
+}
+
+// Update method saves the changes to the movie, provided that it hasn't been changed since it
+// was fetched, and records the new version as a revision made by the user with userID.
+func (m MovieModel) Update(movie *Movie, userID int64) error {
 	// Declare the SQL query for updating the record and returning the new version number.
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		WHERE id = $5 AND version = $6 AND deleted_at IS NULL
 		RETURNING version
 	`
 
@@ -177,6 +475,12 @@ func (m MovieModel) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Creates an args slice containing the values for the placeholder params
 	args := []any{
 		movie.Title,
@@ -189,7 +493,7 @@ func (m MovieModel) Update(movie *Movie) error {
 
 	// Use the QueryRow() method to execute the query, passing in the args slice
 	// as a variadic parameter and scanning the new version into the movie struct.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -199,17 +503,29 @@ func (m MovieModel) Update(movie *Movie) error {
 		}
 	}
 
-	return nil
+	err = insertRevision(ctx, tx, movie, RevisionActionUpdate, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m MovieModel) Delete(id int64) error {
+// Delete method moves the movie to the trash by setting its deleted_at timestamp. Trashed
+// movies are excluded from Get() and GetAll() and can be brought back with Restore() until
+// they are permanently removed by PurgeDeleted(). The deletion is recorded as a new version.
+// As with Update(), ErrEditConflict is returned if the movie isn't at the given version any
+// more, which includes it having been deleted in the meantime.
+func (m MovieModel) Delete(id int64, version int32, userID int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-		DELETE FROM movies
-		WHERE id = $1
+		UPDATE movies
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		RETURNING id, title, year, runtime, genres, version
 	`
 
 	// Use context.WithTimeout() to create a context with 3 seconds of timeout.
@@ -217,18 +533,167 @@ func (m MovieModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	var movie Movie
+
+	err = tx.QueryRowContext(ctx, query, id, version).Scan(
+		&movie.ID,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = insertRevision(ctx, tx, &movie, RevisionActionDelete, userID)
 	if err != nil {
 		return err
 	}
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+
+	return tx.Commit()
+}
+
+// GetAllDeleted() returns a slice of the movies which are currently in the trash.
+func (m MovieModel) GetAllDeleted(filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, rating, review_count, deleted_at
+		FROM movies
+		WHERE deleted_at IS NOT NULL
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.Rating,
+			&movie.ReviewCount,
+			&movie.DeletedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+// Restore method takes a movie out of the trash, recording the restore as a new version.
+func (m MovieModel) Restore(id int64, userID int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE movies
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING id, created_at, title, year, runtime, genres, version, rating, review_count
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var movie Movie
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+		&movie.Rating,
+		&movie.ReviewCount,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = insertRevision(ctx, tx, &movie, RevisionActionRestore, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &movie, nil
+}
+
+// PurgeDeleted method permanently removes the movies which have been in the trash for longer
+// than the retention period, returning the number of movies removed. Their revision history
+// is kept.
+func (m MovieModel) PurgeDeleted(retention time.Duration) (int64, error) {
+	query := `
+		DELETE FROM movies
+		WHERE deleted_at < $1
+	`
+
+	// Purging may touch a large number of rows, so allow it more time than a single
+	// record operation.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return result.RowsAffected()
 }
@@ -0,0 +1,37 @@
+package data
+
+import "testing"
+
+func TestMovieSortValue(t *testing.T) {
+	movie := &Movie{ID: 42, Title: "Moana", Year: 2016, Runtime: 107, Rating: 7.5}
+
+	tests := []struct {
+		column  string
+		want    string
+		wantErr bool
+	}{
+		{column: "id", want: "42"},
+		{column: "title", want: "Moana"},
+		{column: "year", want: "2016"},
+		{column: "runtime", want: "107"},
+		{column: "rating", want: "7.50"},
+		{column: "created_at", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.column, func(t *testing.T) {
+			got, err := movie.sortValue(tt.column)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sortValue(%q) error = %v; want error %t", tt.column, err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("sortValue(%q) = %q; want %q", tt.column, got, tt.want)
+			}
+
+			if !tt.wantErr && !validCursorValue(tt.column, got) {
+				t.Errorf("validCursorValue(%q, %q) = false for a value from sortValue()", tt.column, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/navarrovmn/internal/i18n"
+)
+
+// The states of an outbox message. Pending messages are waiting to be sent, or to be retried
+// after a failure. Dead messages failed too many times, and are only retried on request.
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// An OutboxMessage is an email waiting to be sent. Messages are written in the same transaction
+// as the records they are about, such as a new user and their activation token, so that an
+// email is only ever sent for changes which were committed, and is never lost once they are.
+//
+// The template data can contain tokens, so it isn't included in the message's JSON, and is
+// removed from the database once the message has been sent.
+type OutboxMessage struct {
+	ID            int64          `json:"id"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Recipient     string         `json:"recipient"`
+	Template      string         `json:"template"`
+	Locale        string         `json:"locale"`
+	Data          map[string]any `json:"-"`
+	Status        string         `json:"status"`
+	Attempts      int            `json:"attempts"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	LastError     string         `json:"last_error,omitempty"`
+	SentAt        *time.Time     `json:"sent_at,omitempty"`
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a message to the outbox, to be sent as soon as possible.
+func (m OutboxModel) Insert(message *OutboxMessage) error {
+	return insertOutboxMessage(m.DB, message)
+}
+
+// InsertTx adds a message to the outbox as part of a transaction, so that it is only sent if
+// the transaction is committed.
+func (m OutboxModel) InsertTx(tx *sql.Tx, message *OutboxMessage) error {
+	return insertOutboxMessage(tx, message)
+}
+
+func insertOutboxMessage(q querier, message *OutboxMessage) error {
+	js, err := json.Marshal(message.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO outbox (recipient, template, locale, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status, next_attempt_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if message.Locale == "" {
+		message.Locale = i18n.Default
+	}
+
+	return q.QueryRowContext(ctx, query, message.Recipient, message.Template, message.Locale, string(js)).Scan(
+		&message.ID,
+		&message.CreatedAt,
+		&message.Status,
+		&message.NextAttemptAt,
+	)
+}
+
+// Claim takes up to limit pending messages which are due, for one worker to send. Each one has
+// its attempts counted and its next attempt put back by the lease, so that other workers skip
+// it. If the worker stops before recording the outcome, the message is tried again once the
+// lease runs out.
+func (m OutboxModel) Claim(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	query := `
+		UPDATE outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, recipient, template, locale, data, status, attempts, next_attempt_at, last_error, sent_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var (
+			message OutboxMessage
+			js      []byte
+		)
+
+		err := rows.Scan(
+			&message.ID,
+			&message.CreatedAt,
+			&message.Recipient,
+			&message.Template,
+			&message.Locale,
+			&js,
+			&message.Status,
+			&message.Attempts,
+			&message.NextAttemptAt,
+			&message.LastError,
+			&message.SentAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Numbers are kept as json.Number, so that IDs are formatted by the templates as
+		// integers rather than floats.
+		if js != nil {
+			dec := json.NewDecoder(bytes.NewReader(js))
+			dec.UseNumber()
+
+			err = dec.Decode(&message.Data)
+			if err != nil {
+				return nil, fmt.Errorf("outbox message %d: %w", message.ID, err)
+			}
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkSent records that the message was sent, and removes its template data.
+func (m OutboxModel) MarkSent(id int64) error {
+	query := `
+		UPDATE outbox
+		SET status = 'sent', sent_at = NOW(), data = NULL, last_error = ''
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed records that sending the message failed. It is tried again at retryAt, or, if
+// retryAt is nil, it becomes dead.
+func (m OutboxModel) MarkFailed(id int64, lastError string, retryAt *time.Time) error {
+	query := `
+		UPDATE outbox
+		SET status = CASE WHEN $3::timestamptz IS NULL THEN 'dead' ELSE 'pending' END,
+			next_attempt_at = COALESCE($3, next_attempt_at),
+			last_error = $2
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, lastError, retryAt)
+	return err
+}
+
+func (m OutboxModel) Get(id int64) (*OutboxMessage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, recipient, template, locale, status, attempts, next_attempt_at, last_error, sent_at
+		FROM outbox
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var message OutboxMessage
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&message.ID,
+		&message.CreatedAt,
+		&message.Recipient,
+		&message.Template,
+		&message.Locale,
+		&message.Status,
+		&message.Attempts,
+		&message.NextAttemptAt,
+		&message.LastError,
+		&message.SentAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &message, nil
+}
+
+// GetAll returns a page of messages, in all states if status is empty.
+func (m OutboxModel) GetAll(status string, filters Filters) ([]*OutboxMessage, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, recipient, template, locale, status, attempts, next_attempt_at, last_error, sent_at
+		FROM outbox
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var message OutboxMessage
+
+		err := rows.Scan(
+			&totalRecords,
+			&message.ID,
+			&message.CreatedAt,
+			&message.Recipient,
+			&message.Template,
+			&message.Locale,
+			&message.Status,
+			&message.Attempts,
+			&message.NextAttemptAt,
+			&message.LastError,
+			&message.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return messages, metadata, nil
+}
+
+// Retry puts a dead message back in the queue, with its attempts reset. It returns
+// ErrRecordNotFound if there isn't a dead message with the ID.
+func (m OutboxModel) Retry(id int64) (*OutboxMessage, error) {
+	query := `
+		UPDATE outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'dead'
+		RETURNING id, created_at, recipient, template, locale, status, attempts, next_attempt_at, last_error, sent_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var message OutboxMessage
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&message.ID,
+		&message.CreatedAt,
+		&message.Recipient,
+		&message.Template,
+		&message.Locale,
+		&message.Status,
+		&message.Attempts,
+		&message.NextAttemptAt,
+		&message.LastError,
+		&message.SentAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &message, nil
+}
+
+// RetryAllDead puts every dead message back in the queue, returning how many there were.
+func (m OutboxModel) RetryAllDead() (int64, error) {
+	query := `
+		UPDATE outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE status = 'dead'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
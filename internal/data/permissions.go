@@ -25,12 +25,18 @@ type PermissionModel struct {
 }
 
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	// A user's permissions are those granted to them directly, along with those of their roles.
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN user_permissions ON user_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1
+		WHERE user_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN role_permissions ON role_permissions.permission_id = permissions.id
+		INNER JOIN user_roles ON user_roles.role_id = role_permissions.role_id
+		WHERE user_roles.user_id = $1
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -42,7 +48,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	defer rows.Close()
 
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission string
 
@@ -54,13 +60,45 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		permissions = append(permissions, permission)
 	}
 
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
 	return permissions, nil
 }
 
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	return addPermissionsForUser(m.DB, userID, codes...)
+}
+
+// AddForUserTx grants the permissions to the user as part of a transaction.
+func (m PermissionModel) AddForUserTx(tx *sql.Tx, userID int64, codes ...string) error {
+	return addPermissionsForUser(tx, userID, codes...)
+}
+
+func addPermissionsForUser(q querier, userID int64, codes ...string) error {
 	query := `
 		INSERT INTO user_permissions
 		SELECT $1, permissions.id FROM permissions where permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := q.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// RemoveForUser takes permissions which were granted to the user directly away again. The user
+// keeps any of them which come with their roles.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+		DELETE FROM user_permissions
+		USING permissions
+		WHERE user_permissions.permission_id = permissions.id
+		AND user_permissions.user_id = $1
+		AND permissions.code = ANY($2)
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -69,3 +107,100 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// GetAllForAPIKey returns the permissions of an API key. A key never has more permissions than
+// its user, so permissions which have since been taken away from the user are left out. The keys
+// of service accounts are also capped at the permissions which the account's owner has now.
+func (m PermissionModel) GetAllForAPIKey(apiKeyID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN api_keys_permissions ON api_keys_permissions.permission_id = permissions.id
+		INNER JOIN api_keys ON api_keys_permissions.api_key_id = api_keys.id
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.id = $1
+		AND permissions.id IN (
+			SELECT user_permissions.permission_id
+			FROM user_permissions
+			WHERE user_permissions.user_id = users.id
+			UNION
+			SELECT role_permissions.permission_id
+			FROM role_permissions
+			INNER JOIN user_roles ON user_roles.role_id = role_permissions.role_id
+			WHERE user_roles.user_id = users.id
+		)
+		AND (users.owner_id IS NULL OR permissions.id IN (
+			SELECT user_permissions.permission_id
+			FROM user_permissions
+			WHERE user_permissions.user_id = users.owner_id
+			UNION
+			SELECT role_permissions.permission_id
+			FROM role_permissions
+			INNER JOIN user_roles ON user_roles.role_id = role_permissions.role_id
+			WHERE user_roles.user_id = users.owner_id
+		))
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// GetAll returns every permission code.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
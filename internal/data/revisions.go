@@ -0,0 +1,203 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	RevisionActionCreate  = "create"
+	RevisionActionUpdate  = "update"
+	RevisionActionDelete  = "delete"
+	RevisionActionRestore = "restore"
+)
+
+// A MovieRevision is a snapshot of a movie as it was at a specific version, along with
+// the action which produced it and the user who performed it.
+type MovieRevision struct {
+	ID        int64     `json:"id"`
+	MovieID   int64     `json:"movie_id"`
+	Version   int32     `json:"version"`
+	Action    string    `json:"action"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year,omitempty"`
+	Runtime   Runtime   `json:"runtime,omitempty"`
+	Genres    []string  `json:"genres,omitempty"`
+	UserID    *int64    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The insertRevision() function records a snapshot of the movie. It takes a transaction
+// so that the revision is written atomically with the change to the movie itself.
+func insertRevision(ctx context.Context, tx *sql.Tx, movie *Movie, action string, userID int64) error {
+	query := `
+		INSERT INTO movie_revisions (movie_id, version, action, title, year, runtime, genres, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	args := []any{
+		movie.ID,
+		movie.Version,
+		action,
+		movie.Title,
+		movie.Year,
+		movie.Runtime,
+		pq.Array(movie.Genres),
+		sql.NullInt64{Int64: userID, Valid: userID > 0},
+	}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// The copyRevisions() function is the bulk counterpart of insertRevision(). It records the
+// snapshots of many movies with a single COPY statement.
+func copyRevisions(ctx context.Context, tx *sql.Tx, movies []*Movie, action string, userID int64) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("movie_revisions", "movie_id", "version", "action", "title", "year", "runtime", "genres", "user_id"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, movie := range movies {
+		args := []any{
+			movie.ID,
+			movie.Version,
+			action,
+			movie.Title,
+			movie.Year,
+			movie.Runtime,
+			pq.Array(movie.Genres),
+			sql.NullInt64{Int64: userID, Valid: userID > 0},
+		}
+
+		_, err = stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return stmt.Close()
+}
+
+type RevisionModel struct {
+	DB *sql.DB
+}
+
+// GetAllForMovie() returns a page of the movie's revisions. A movie which doesn't exist, or
+// which has been purged from the trash, is ErrRecordNotFound rather than an empty list, even
+// though the revisions of a purged movie are kept. Movies in the trash still have a history.
+func (m RevisionModel) GetAllForMovie(movieID int64, filters Filters) ([]*MovieRevision, Metadata, error) {
+	if movieID < 1 {
+		return nil, Metadata{}, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM movies WHERE id = $1)`, movieID).Scan(&exists)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	if !exists {
+		return nil, Metadata{}, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, movie_id, version, action, title, year, runtime, genres, user_id, created_at
+		FROM movie_revisions
+		WHERE movie_id = $1
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	revisions := []*MovieRevision{}
+
+	for rows.Next() {
+		var revision MovieRevision
+
+		err := rows.Scan(
+			&totalRecords,
+			&revision.ID,
+			&revision.MovieID,
+			&revision.Version,
+			&revision.Action,
+			&revision.Title,
+			&revision.Year,
+			&revision.Runtime,
+			pq.Array(&revision.Genres),
+			&revision.UserID,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return revisions, metadata, nil
+}
+
+func (m RevisionModel) Get(movieID int64, version int32) (*MovieRevision, error) {
+	if movieID < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, movie_id, version, action, title, year, runtime, genres, user_id, created_at
+		FROM movie_revisions
+		WHERE movie_id = $1 AND version = $2`
+
+	var revision MovieRevision
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, version).Scan(
+		&revision.ID,
+		&revision.MovieID,
+		&revision.Version,
+		&revision.Action,
+		&revision.Title,
+		&revision.Year,
+		&revision.Runtime,
+		pq.Array(&revision.Genres),
+		&revision.UserID,
+		&revision.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"github.com/navarrovmn/internal/validator"
 	"time"
 )
@@ -14,14 +15,44 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMFA            = "mfa"
+	ScopeMagicLink      = "magic-link"
 )
 
+// ErrRefreshTokenReused is returned when a refresh token which has already been exchanged is
+// presented again. Since only one client should ever hold it, this suggests that the token
+// was stolen.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
 type Token struct {
+	ID        int64     `json:"-"`
+	FamilyID  int64     `json:"-"`
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Payload   string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+}
+
+// A Session describes a signed in client without revealing its tokens. Every sign in starts a
+// new family of tokens: the authentication token and, if one was asked for, the chain of
+// refresh tokens which replace it. The session ID is the ID of the family. It is not secret,
+// so it can be used to refer to the session, for example to revoke it.
+type Session struct {
+	ID         int64      `json:"id"`
+	TokenID    int64      `json:"-"`
+	UserID     int64      `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -46,8 +77,8 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(tokenPlaintext != "", "token", "required")
+	v.Check(len(tokenPlaintext) == 26, "token", "exact-bytes", 26)
 }
 
 type TokenModel struct {
@@ -64,21 +95,312 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewTx creates a token as part of a transaction.
+func (m TokenModel) NewTx(tx *sql.Tx, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertToken(tx, token)
+	return token, err
+}
+
+// NewWithPayload creates a token which carries some data along with it, such as the pending
+// address of an email change. The payload is only ever stored server-side.
+func (m TokenModel) NewWithPayload(userID int64, ttl time.Duration, scope, payload string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Payload = payload
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewWithPayloadTx creates a token with a payload as part of a transaction.
+func (m TokenModel) NewWithPayloadTx(tx *sql.Tx, userID int64, ttl time.Duration, scope, payload string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Payload = payload
+
+	err = insertToken(tx, token)
+	return token, err
+}
+
+// NewSession creates an authentication token, recording the user agent and IP address of the
+// client which signed in. If refreshTTL is greater than zero, a refresh token in the same
+// family is created along with it.
+func (m TokenModel) NewSession(userID int64, ttl, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	token, refreshToken, err := insertSession(ctx, tx, userID, 0, ttl, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, refreshToken, tx.Commit()
+}
+
+// Rotate exchanges a refresh token for a new authentication token and refresh token in the
+// same family. Each refresh token can only be used once: if a used one is presented again,
+// the whole family is revoked and ErrRefreshTokenReused is returned, so that neither the
+// thief nor the legitimate client can carry on with it.
+func (m TokenModel) Rotate(refreshPlaintext string, ttl, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	query := `
+		SELECT id, family_id, user_id, expiry, used_at
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		FOR UPDATE`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		current Token
+		usedAt  *time.Time
+	)
+
+	err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh).Scan(
+		&current.ID,
+		&current.FamilyID,
+		&current.UserID,
+		&current.Expiry,
+		&usedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if usedAt != nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id = $1`, current.FamilyID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	if !current.Expiry.After(time.Now()) {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	// Used refresh tokens are kept until they expire, so that replays can be detected. The
+	// authentication tokens which they replaced are no longer needed.
+	query = `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, current.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE family_id = $1 AND scope = $2`
+
+	_, err = tx.ExecContext(ctx, query, current.FamilyID, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, refreshToken, err := insertSession(ctx, tx, current.UserID, current.FamilyID, ttl, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, refreshToken, tx.Commit()
+}
+
+// insertSession creates an authentication token if ttl is greater than zero, and a refresh
+// token if refreshTTL is greater than zero, in the given family. A familyID of zero starts a
+// new family.
+func insertSession(ctx context.Context, tx *sql.Tx, userID, familyID int64, ttl, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	if familyID == 0 {
+		err := tx.QueryRowContext(ctx, `SELECT nextval('tokens_family_id_seq')`).Scan(&familyID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var (
+		tokens       []*Token
+		token        *Token
+		refreshToken *Token
+		err          error
+	)
+
+	if ttl > 0 {
+		token, err = generateToken(userID, ttl, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	if refreshTTL > 0 {
+		refreshToken, err = generateToken(userID, refreshTTL, ScopeRefresh)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tokens = append(tokens, refreshToken)
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`
+
+	for _, t := range tokens {
+		t.FamilyID = familyID
+		t.UserAgent = userAgent
+		t.IP = ip
+
+		args := []any{t.Hash, t.UserID, t.Expiry, t.Scope, t.UserAgent, t.IP, t.FamilyID}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&t.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return token, refreshToken, nil
+}
+
 func (m TokenModel) Insert(token *Token) error {
+	return insertToken(m.DB, token)
+}
+
+func insertToken(q querier, token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (hash, user_id, expiry, scope, payload, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, family_id`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Payload, token.UserAgent, token.IP}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return q.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.FamilyID)
+}
+
+// GetForUser returns the unexpired token in the scope with the given plaintext, provided that
+// it belongs to the user.
+func (m TokenModel) GetForUser(scope string, userID int64, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT hash, user_id, expiry, scope, payload
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND user_id = $3
+		AND expiry > $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := Token{Plaintext: tokenPlaintext}
+	args := []any{tokenHash[:], scope, userID, time.Now()}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Payload,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Redeem deletes the unexpired token in the scope with the given plaintext, provided that it
+// belongs to the user, so that it can't be used again. The check and the deletion are a single
+// statement, so that if the token is presented twice at the same time only one of the requests
+// redeems it. It returns ErrRecordNotFound if the token has already been redeemed or has expired.
+func (m TokenModel) Redeem(scope string, userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND user_id = $3
+		AND expiry > $4
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{tokenHash[:], scope, userID, time.Now()}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	return deleteAllTokensForUser(m.DB, scope, userID)
+}
+
+// DeleteAllForUserTx deletes the user's tokens of the scope as part of a transaction.
+func (m TokenModel) DeleteAllForUserTx(tx *sql.Tx, scope string, userID int64) error {
+	return deleteAllTokensForUser(tx, scope, userID)
+}
+
+func deleteAllTokensForUser(q querier, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2`
@@ -86,6 +408,203 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	_, err := q.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+// GetSession returns the session for an unexpired authentication token.
+func (m TokenModel) GetSession(tokenPlaintext string) (*Session, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT family_id, id, user_id, created_at, last_used_at, expiry, user_agent, ip
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND expiry > $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var session Session
+	args := []any{tokenHash[:], ScopeAuthentication, time.Now()}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&session.ID,
+		&session.TokenID,
+		&session.UserID,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.Expiry,
+		&session.UserAgent,
+		&session.IP,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &session, nil
+}
+
+// SessionStatus reports whether the user's session with the ID still has an unexpired
+// authentication token, that is whether it has been neither revoked nor signed out of, and
+// whether the user is suspended. JWTs carry the ID of their session, and are only accepted
+// while it is active and its user isn't suspended.
+func (m TokenModel) SessionStatus(userID, id int64) (active, suspended bool, err error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM tokens
+			WHERE family_id = $1
+			AND user_id = $2
+			AND scope = $3
+			AND expiry > $4
+		), EXISTS (
+			SELECT 1
+			FROM users
+			WHERE id = $2
+			AND suspended_at IS NOT NULL
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, id, userID, ScopeAuthentication, time.Now()).Scan(&active, &suspended)
+	return active, suspended, err
+}
+
+// GetAllSessionsForUser returns the user's sessions which still have an unexpired
+// authentication token or an unused refresh token, most recently used first. The user agent
+// and IP address are those of the last client to use the session.
+func (m TokenModel) GetAllSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT family_id, user_id, MIN(created_at), MAX(last_used_at),
+			MAX(expiry) FILTER (WHERE used_at IS NULL),
+			(array_agg(user_agent ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC))[1],
+			(array_agg(ip ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC))[1]
+		FROM tokens
+		WHERE user_id = $1
+		AND scope IN ($2, $3)
+		GROUP BY family_id, user_id
+		HAVING bool_or(expiry > $4 AND used_at IS NULL)
+		ORDER BY COALESCE(MAX(last_used_at), MIN(created_at)) DESC, family_id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, ScopeAuthentication, ScopeRefresh, time.Now()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records that an authentication token was used just now, and by which client.
+func (m TokenModel) TouchSession(tokenID int64, userAgent, ip string) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW(), user_agent = $2, ip = $3
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenID, userAgent, ip)
+	return err
+}
+
+// DeleteSession revokes one of the user's sessions, along with any refresh tokens for it.
+func (m TokenModel) DeleteSession(userID, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family_id = $1 AND user_id = $2 AND scope IN ($3, $4)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllSessionsForUser revokes all of the user's sessions.
+func (m TokenModel) DeleteAllSessionsForUser(userID int64) error {
+	return deleteAllSessionsForUser(m.DB, userID)
+}
+
+// DeleteAllSessionsForUserTx revokes all of the user's sessions as part of a transaction.
+func (m TokenModel) DeleteAllSessionsForUserTx(tx *sql.Tx, userID int64) error {
+	return deleteAllSessionsForUser(tx, userID)
+}
+
+func deleteAllSessionsForUser(q querier, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := q.ExecContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh)
+	return err
+}
+
+// DeleteAllSessionsForUserExcept revokes all of the user's sessions apart from the one with
+// the given ID, for example to sign out every other session of the user.
+func (m TokenModel) DeleteAllSessionsForUserExcept(userID, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3) AND family_id <> $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh, id)
 	return err
 }
@@ -5,8 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"github.com/navarrovmn/internal/i18n"
 	"github.com/navarrovmn/internal/validator"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
@@ -16,38 +19,57 @@ var (
 
 var AnonymousUser = &User{}
 
-// Define an User struct to represent an individual user. Password field uses custom type
+// Define an User struct to represent an individual user. Password field uses custom type.
+// Service accounts are users for batch jobs and integrations: they are owned by the user who
+// created them, and can only authenticate with API keys. A suspended user can't sign in or
+// use any of their credentials until an administrator lifts the suspension.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	Password       password   `json:"-"`
+	Activated      bool       `json:"activated"`
+	ServiceAccount bool       `json:"service_account"`
+	OwnerID        *int64     `json:"owner_id,omitempty"`
+	SuspendedAt    *time.Time `json:"suspended_at,omitempty"`
+	Locale         string     `json:"locale"`
+	Version        int        `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt != nil
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
-	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+	v.Check(email != "", "email", "required")
+	v.Check(validator.Matches(email, validator.EmailRX), "email", "invalid-email")
 }
 
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(password != "", "password", "required")
+	v.Check(len(password) >= 8, "password", "min-bytes", 8)
+	v.Check(len(password) <= 72, "password", "max-bytes", 72)
+}
+
+// ValidateLocale checks that the locale is one of the supported locales. Callers should first
+// normalize what the client sent with i18n.Match().
+func ValidateLocale(v *validator.Validator, locale string) {
+	v.Check(validator.PermittedValue(locale, i18n.Supported...), "locale", "unsupported-locale", strings.Join(i18n.Supported, ", "))
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(user.Name != "", "name", "required")
+	v.Check(len(user.Name) <= 500, "name", "max-bytes", 500)
 
 	ValidateEmail(v, user.Email)
 
+	ValidateLocale(v, user.Locale)
+
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
 	}
@@ -97,16 +119,25 @@ type UserModel struct {
 }
 
 func (m UserModel) Insert(user *User) error {
+	return insertUser(m.DB, user)
+}
+
+// InsertTx inserts the user as part of a transaction.
+func (m UserModel) InsertTx(tx *sql.Tx, user *User) error {
+	return insertUser(tx, user)
+}
+
+func insertUser(q querier, user *User) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, service_account, owner_id, locale)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, created_at, version
 	`
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.ServiceAccount, user.OwnerID, user.Locale}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -119,9 +150,50 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, service_account, owner_id, suspended_at, locale, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.ServiceAccount,
+		&user.OwnerID,
+		&user.SuspendedAt,
+		&user.Locale,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, service_account, owner_id, suspended_at, locale, version
 		FROM users
 		WHERE email = $1
 	`
@@ -137,6 +209,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.ServiceAccount,
+		&user.OwnerID,
+		&user.SuspendedAt,
+		&user.Locale,
 		&user.Version,
 	)
 
@@ -153,10 +229,19 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 func (m UserModel) Update(user *User) error {
+	return updateUser(m.DB, user)
+}
+
+// UpdateTx updates the user as part of a transaction.
+func (m UserModel) UpdateTx(tx *sql.Tx, user *User) error {
+	return updateUser(tx, user)
+}
+
+func updateUser(q querier, user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, suspended_at = $5, locale = $6, version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version
 	`
 	args := []any{
@@ -164,6 +249,8 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.SuspendedAt,
+		user.Locale,
 		user.ID,
 		user.Version,
 	}
@@ -171,7 +258,7 @@ func (m UserModel) Update(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -190,7 +277,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.service_account, users.owner_id, users.suspended_at, users.locale, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -210,6 +297,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.ServiceAccount,
+		&user.OwnerID,
+		&user.SuspendedAt,
+		&user.Locale,
 		&user.Version,
 	)
 	if err != nil {
@@ -223,3 +314,216 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	return &user, nil
 }
+
+// GetAll returns a page of users, including service accounts. The email filter matches any part
+// of the address, and the other filters are ignored when they are nil.
+func (m UserModel) GetAll(email string, activated, suspended *bool, createdAfter, createdBefore *time.Time, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, service_account, owner_id, suspended_at, locale, version
+		FROM users
+		WHERE (strpos(email, $1::citext) > 0 OR $1 = '')
+		AND (activated = $2 OR $2 IS NULL)
+		AND ((suspended_at IS NOT NULL) = $3 OR $3 IS NULL)
+		AND (created_at >= $4 OR $4 IS NULL)
+		AND (created_at < $5 OR $5 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $6 OFFSET $7`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{email, activated, suspended, createdAfter, createdBefore, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.ServiceAccount,
+			&user.OwnerID,
+			&user.SuspendedAt,
+			&user.Locale,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// Delete permanently deletes a user, along with their tokens, permissions and service accounts.
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllServiceAccounts returns the service accounts owned by the user.
+func (m UserModel) GetAllServiceAccounts(ownerID int64) ([]*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, service_account, owner_id, suspended_at, locale, version
+		FROM users
+		WHERE owner_id = $1 AND service_account
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.ServiceAccount,
+			&user.OwnerID,
+			&user.SuspendedAt,
+			&user.Locale,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SuspendServiceAccounts suspends the service accounts owned by the user which aren't suspended
+// already, and returns their IDs. Lifting the owner's suspension doesn't lift theirs.
+func (m UserModel) SuspendServiceAccounts(ownerID int64) ([]int64, error) {
+	return suspendServiceAccounts(m.DB, ownerID)
+}
+
+// SuspendServiceAccountsTx suspends the user's service accounts as part of a transaction.
+func (m UserModel) SuspendServiceAccountsTx(tx *sql.Tx, ownerID int64) ([]int64, error) {
+	return suspendServiceAccounts(tx, ownerID)
+}
+
+func suspendServiceAccounts(q querier, ownerID int64) ([]int64, error) {
+	query := `
+		UPDATE users
+		SET suspended_at = NOW(), version = version + 1
+		WHERE owner_id = $1 AND service_account AND suspended_at IS NULL
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := q.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// DeleteServiceAccount deletes one of the user's service accounts, along with its API keys.
+func (m UserModel) DeleteServiceAccount(ownerID, id int64) error {
+	query := `
+		DELETE FROM users
+		WHERE id = $1 AND owner_id = $2 AND service_account`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, ownerID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
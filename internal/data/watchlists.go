@@ -0,0 +1,335 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateWatchlistItem = errors.New("duplicate watchlist item")
+	ErrWatchlistMismatch      = errors.New("watchlist mismatch")
+)
+
+// A WatchlistItem is a movie on a user's watchlist. Items are ordered by their position,
+// starting at 1, which the user can change.
+type WatchlistItem struct {
+	Position int32     `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+	Movie    *Movie    `json:"movie"`
+}
+
+// A WatchedMovie is an entry in a user's watched history.
+type WatchedMovie struct {
+	WatchedAt time.Time `json:"watched_at"`
+	Movie     *Movie    `json:"movie"`
+}
+
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// Add method puts the movie at the end of the user's watchlist.
+func (m WatchlistModel) Add(userID, movieID int64) (*WatchlistItem, error) {
+	query := `
+		INSERT INTO watchlist_items (user_id, movie_id, position)
+		SELECT $1, movies.id, COALESCE((SELECT max(position) FROM watchlist_items WHERE user_id = $1), 0) + 1
+		FROM movies
+		WHERE movies.id = $2 AND movies.deleted_at IS NULL
+		RETURNING position, added_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var item WatchlistItem
+
+	err := m.DB.QueryRowContext(ctx, query, userID, movieID).Scan(&item.Position, &item.AddedAt)
+	if err != nil {
+		switch {
+		// No row is inserted if there isn't a movie with the ID.
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlist_items_pkey"`:
+			return nil, ErrDuplicateWatchlistItem
+		default:
+			return nil, err
+		}
+	}
+
+	return &item, nil
+}
+
+func (m WatchlistModel) Remove(userID, movieID int64) error {
+	query := `
+		DELETE FROM watchlist_items
+		WHERE user_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Reorder method sets the order of the user's watchlist to the order of movieIDs, which must
+// contain every movie on the watchlist exactly once. Otherwise it returns ErrWatchlistMismatch
+// and the watchlist is left unchanged. Movies in the trash aren't listed by GetAll(), so they
+// aren't expected in movieIDs either: they are kept after the others, in the order they were in.
+func (m WatchlistModel) Reorder(userID int64, movieIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+
+	query := `
+		SELECT count(*)
+		FROM watchlist_items
+		INNER JOIN movies ON movies.id = watchlist_items.movie_id
+		WHERE watchlist_items.user_id = $1 AND movies.deleted_at IS NULL`
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE watchlist_items
+		SET position = ordered.position
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS ordered(movie_id, position), movies
+		WHERE watchlist_items.user_id = $1 AND watchlist_items.movie_id = ordered.movie_id
+		AND movies.id = watchlist_items.movie_id AND movies.deleted_at IS NULL`
+
+	result, err := tx.ExecContext(ctx, query, userID, pq.Array(movieIDs))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count != len(movieIDs) || rowsAffected != int64(count) {
+		return ErrWatchlistMismatch
+	}
+
+	query = `
+		UPDATE watchlist_items
+		SET position = hidden.position
+		FROM (
+			SELECT watchlist_items.movie_id, $2 + row_number() OVER (ORDER BY watchlist_items.position, watchlist_items.movie_id) AS position
+			FROM watchlist_items
+			INNER JOIN movies ON movies.id = watchlist_items.movie_id
+			WHERE watchlist_items.user_id = $1 AND movies.deleted_at IS NOT NULL
+		) AS hidden
+		WHERE watchlist_items.user_id = $1 AND watchlist_items.movie_id = hidden.movie_id`
+
+	_, err = tx.ExecContext(ctx, query, userID, count)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAll() returns the movies on the user's watchlist which match the title and genres filters.
+func (m WatchlistModel) GetAll(userID int64, title string, genres []string, filters Filters) ([]*WatchlistItem, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), watchlist_items.position, watchlist_items.added_at,
+			movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.version, movies.rating, movies.review_count
+		FROM watchlist_items
+		INNER JOIN movies ON movies.id = watchlist_items.movie_id
+		WHERE watchlist_items.user_id = $1
+		AND (to_tsvector('simple', movies.title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND (movies.genres @> $3 OR $3 = '{}')
+		AND movies.deleted_at IS NULL
+		ORDER BY %s %s, movies.id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, title, pq.Array(genres), filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*WatchlistItem{}
+
+	for rows.Next() {
+		item := WatchlistItem{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&item.Position,
+			&item.AddedAt,
+			&item.Movie.ID,
+			&item.Movie.CreatedAt,
+			&item.Movie.Title,
+			&item.Movie.Year,
+			&item.Movie.Runtime,
+			pq.Array(&item.Movie.Genres),
+			&item.Movie.Version,
+			&item.Movie.Rating,
+			&item.Movie.ReviewCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return items, metadata, nil
+}
+
+type WatchedModel struct {
+	DB *sql.DB
+}
+
+// Mark method records that the user watched the movie at watchedAt. If the movie is already in
+// the user's history, its watched-at time is updated.
+func (m WatchedModel) Mark(userID, movieID int64, watchedAt time.Time) error {
+	query := `
+		INSERT INTO watched_movies (user_id, movie_id, watched_at)
+		SELECT $1, movies.id, $3
+		FROM movies
+		WHERE movies.id = $2 AND movies.deleted_at IS NULL
+		ON CONFLICT (user_id, movie_id) DO UPDATE SET watched_at = EXCLUDED.watched_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID, watchedAt)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m WatchedModel) Remove(userID, movieID int64) error {
+	query := `
+		DELETE FROM watched_movies
+		WHERE user_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll() returns the movies in the user's watched history which match the title and genres filters.
+func (m WatchedModel) GetAll(userID int64, title string, genres []string, filters Filters) ([]*WatchedMovie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), watched_movies.watched_at,
+			movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.version, movies.rating, movies.review_count
+		FROM watched_movies
+		INNER JOIN movies ON movies.id = watched_movies.movie_id
+		WHERE watched_movies.user_id = $1
+		AND (to_tsvector('simple', movies.title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND (movies.genres @> $3 OR $3 = '{}')
+		AND movies.deleted_at IS NULL
+		ORDER BY %s %s, movies.id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, title, pq.Array(genres), filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	watched := []*WatchedMovie{}
+
+	for rows.Next() {
+		entry := WatchedMovie{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.WatchedAt,
+			&entry.Movie.ID,
+			&entry.Movie.CreatedAt,
+			&entry.Movie.Title,
+			&entry.Movie.Year,
+			&entry.Movie.Runtime,
+			pq.Array(&entry.Movie.Genres),
+			&entry.Movie.Version,
+			&entry.Movie.Rating,
+			&entry.Movie.ReviewCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		watched = append(watched, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return watched, metadata, nil
+}
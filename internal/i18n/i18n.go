@@ -0,0 +1,144 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Default is the locale used when the client doesn't ask for a supported one, and for any
+// message which hasn't been translated.
+const Default = "en"
+
+// Supported lists the locales which have a message catalog.
+var Supported = []string{"en", "pt-BR", "es"}
+
+//go:embed "locales"
+var localeFS embed.FS
+
+// The catalogs map each locale to its messages, keyed by stable codes such as "not-found" or
+// "max-bytes". A message can have fmt verbs, which are filled in from the args passed to
+// Translate().
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	catalogs := make(map[string]map[string]string, len(Supported))
+
+	for _, locale := range Supported {
+		js, err := localeFS.ReadFile("locales/" + locale + ".json")
+		if err != nil {
+			panic(err)
+		}
+
+		var catalog map[string]string
+		err = json.Unmarshal(js, &catalog)
+		if err != nil {
+			panic(fmt.Sprintf("locales/%s.json: %s", locale, err))
+		}
+
+		catalogs[locale] = catalog
+	}
+
+	return catalogs
+}
+
+// Translate returns the message for the code in the locale, falling back to the default locale
+// if it hasn't been translated, and to the code itself if there is no such message.
+func Translate(locale, code string, args ...any) string {
+	message, ok := catalogs[locale][code]
+	if !ok {
+		message, ok = catalogs[Default][code]
+		if !ok {
+			return code
+		}
+	}
+
+	if len(args) == 0 {
+		return message
+	}
+
+	return fmt.Sprintf(message, args...)
+}
+
+// Match returns the supported locale for a language tag, such as "pt-BR" for "pt-br". A tag for
+// another region of a supported language matches that language, so "es-MX" gives "es" and
+// "pt-PT" gives "pt-BR". It returns false if the language isn't supported.
+func Match(tag string) (string, bool) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", false
+	}
+
+	for _, locale := range Supported {
+		if strings.EqualFold(tag, locale) {
+			return locale, true
+		}
+	}
+
+	language, _, _ := strings.Cut(tag, "-")
+
+	for _, locale := range Supported {
+		base, _, _ := strings.Cut(locale, "-")
+		if strings.EqualFold(language, base) {
+			return locale, true
+		}
+	}
+
+	return "", false
+}
+
+// Negotiate returns the supported locale which the client prefers, from the value of an
+// Accept-Language header. Languages are considered in order of their quality values, and the
+// order they are listed in for equal ones. It returns an empty string if none of them are
+// supported, so that the caller can choose its own fallback.
+func Negotiate(acceptLanguage string) string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+
+	var ranges []languageRange
+
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if tag = strings.TrimSpace(tag); tag != "" && quality > 0 {
+			ranges = append(ranges, languageRange{tag: tag, quality: quality})
+		}
+	}
+
+	slices.SortStableFunc(ranges, func(a, b languageRange) int {
+		switch {
+		case a.quality > b.quality:
+			return -1
+		case a.quality < b.quality:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	for _, r := range ranges {
+		if r.tag == "*" {
+			return Default
+		}
+
+		if locale, ok := Match(r.tag); ok {
+			return locale
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,150 @@
+package i18n
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		tag    string
+		want   string
+		wantOK bool
+	}{
+		{tag: "en", want: "en", wantOK: true},
+		{tag: "EN", want: "en", wantOK: true},
+		{tag: "pt-BR", want: "pt-BR", wantOK: true},
+		{tag: "pt-br", want: "pt-BR", wantOK: true},
+		{tag: " es ", want: "es", wantOK: true},
+		{tag: "en-GB", want: "en", wantOK: true},
+		{tag: "es-MX", want: "es", wantOK: true},
+		{tag: "pt-PT", want: "pt-BR", wantOK: true},
+		{tag: "pt", want: "pt-BR", wantOK: true},
+		{tag: "fr", want: "", wantOK: false},
+		{tag: "fr-CA", want: "", wantOK: false},
+		{tag: "*", want: "", wantOK: false},
+		{tag: "", want: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			got, ok := Match(tt.tag)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Match(%q) = %q, %v; want %q, %v", tt.tag, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		want           string
+	}{
+		{name: "empty", acceptLanguage: "", want: ""},
+		{name: "single", acceptLanguage: "es", want: "es"},
+		{name: "first listed wins", acceptLanguage: "pt-BR, es", want: "pt-BR"},
+		{name: "highest quality wins", acceptLanguage: "es;q=0.5, pt-BR;q=0.9", want: "pt-BR"},
+		{name: "missing quality is 1", acceptLanguage: "es;q=0.9, pt-BR", want: "pt-BR"},
+		{name: "equal quality keeps order", acceptLanguage: "es;q=0.8, pt-BR;q=0.8", want: "es"},
+		{name: "unsupported skipped", acceptLanguage: "fr-FR, fr;q=0.9, es;q=0.8", want: "es"},
+		{name: "region fallback", acceptLanguage: "pt-PT, en;q=0.5", want: "pt-BR"},
+		{name: "region fallback for es", acceptLanguage: "es-AR", want: "es"},
+		{name: "wildcard", acceptLanguage: "fr, *;q=0.5", want: Default},
+		{name: "wildcard after supported", acceptLanguage: "*;q=0.1, es;q=0.2", want: "es"},
+		{name: "zero quality excluded", acceptLanguage: "es;q=0, pt-BR;q=0.1", want: "pt-BR"},
+		{name: "only zero quality", acceptLanguage: "es;q=0", want: ""},
+		{name: "invalid quality ignored", acceptLanguage: "es;q=high, pt-BR;q=0.2", want: "pt-BR"},
+		{name: "none supported", acceptLanguage: "fr, de;q=0.9", want: ""},
+		{name: "spaces and case", acceptLanguage: "  PT-br ;q=0.7 ,  ", want: "pt-BR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Negotiate(tt.acceptLanguage); got != tt.want {
+				t.Errorf("Negotiate(%q) = %q; want %q", tt.acceptLanguage, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		name   string
+		locale string
+		code   string
+		args   []any
+		want   string
+	}{
+		{name: "default locale", locale: "en", code: "not-found", want: "the requested resource could not be found"},
+		{name: "translated", locale: "pt-BR", code: "not-found", want: catalogs["pt-BR"]["not-found"]},
+		{name: "args", locale: "en", code: "max-bytes", args: []any{500}, want: "must not be more than 500 bytes long"},
+		{name: "translated with args", locale: "es", code: "between", args: []any{1, 5}, want: "debe estar entre 1 y 5"},
+		{name: "unsupported locale falls back", locale: "fr", code: "required", want: "must be provided"},
+		{name: "empty locale falls back", locale: "", code: "required", want: "must be provided"},
+		{name: "unknown code", locale: "es", code: "no-such-code", want: "no-such-code"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Translate(tt.locale, tt.code, tt.args...); got != tt.want {
+				t.Errorf("Translate(%q, %q) = %q; want %q", tt.locale, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslateMissingFallsBackToDefault(t *testing.T) {
+	catalogs[Default]["test-only"] = "only in %s"
+	t.Cleanup(func() { delete(catalogs[Default], "test-only") })
+
+	if got := Translate("es", "test-only", "English"); got != "only in English" {
+		t.Errorf("Translate() = %q; want %q", got, "only in English")
+	}
+}
+
+// Every locale should have a message for every code, with the same fmt verbs in the same order,
+// so that no message falls back to English and args are always filled in correctly.
+func TestCatalogsComplete(t *testing.T) {
+	for _, locale := range Supported {
+		if locale == Default {
+			continue
+		}
+
+		for code, message := range catalogs[Default] {
+			translated, ok := catalogs[locale][code]
+			if !ok {
+				t.Errorf("%s: missing %q", locale, code)
+				continue
+			}
+
+			if got, want := verbs(translated), verbs(message); !slices.Equal(got, want) {
+				t.Errorf("%s: %q has verbs %v; want %v", locale, code, got, want)
+			}
+		}
+
+		for code := range catalogs[locale] {
+			if _, ok := catalogs[Default][code]; !ok {
+				t.Errorf("%s: %q isn't in the %s catalog", locale, code, Default)
+			}
+		}
+	}
+}
+
+func verbs(message string) []string {
+	var verbs []string
+
+	for i := 0; i < len(message)-1; i++ {
+		if message[i] != '%' {
+			continue
+		}
+
+		i++
+		if message[i] != '%' {
+			verbs = append(verbs, string(message[i]))
+		}
+	}
+
+	return verbs
+}
@@ -0,0 +1,291 @@
+// Package jwt signs and verifies the JSON Web Tokens (RFC 7519) which the API issues when it runs
+// in its stateless authentication mode. Only the compact serialization is supported, signed with
+// either HS256 (HMAC with SHA-256) or EdDSA (Ed25519).
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The signing algorithms, as named in the "alg" header.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	ErrExpiredToken = errors.New("jwt: token has expired")
+	ErrUnknownKey   = errors.New("jwt: unknown key")
+)
+
+// Claims holds the registered claims which the API uses, along with its own claims about the
+// user. SessionID is the session which the token was issued for, which signing out revokes.
+type Claims struct {
+	Issuer      string   `json:"iss,omitempty"`
+	Subject     string   `json:"sub"`
+	IssuedAt    int64    `json:"iat"`
+	NotBefore   int64    `json:"nbf,omitempty"`
+	Expiry      int64    `json:"exp"`
+	SessionID   int64    `json:"sid,omitempty"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"permissions"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid"`
+}
+
+// A Key is a named key for one algorithm. HS256 keys are shared secrets. EdDSA keys are either a
+// private key, which can sign and verify tokens, or a public key, which can only verify them.
+// Keeping the public key of a retired private key around lets tokens which it signed carry on
+// working until they expire.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// NewKey creates a key from its material: the secret itself for HS256, which must be at least
+// 32 bytes long, or a PEM encoded PKCS #8 private key or PKIX public key for EdDSA.
+func NewKey(id, algorithm string, material []byte) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("jwt: key ID must be provided")
+	}
+
+	key := &Key{ID: id, Algorithm: algorithm}
+
+	switch algorithm {
+	case HS256:
+		if len(material) < 32 {
+			return nil, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes long", id)
+		}
+		key.secret = material
+
+	case EdDSA:
+		block, _ := pem.Decode(material)
+		if block == nil {
+			return nil, fmt.Errorf("jwt: EdDSA key %q must be PEM encoded", id)
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("jwt: key %q: %w", id, err)
+			}
+
+			private, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: key %q is not an Ed25519 private key", id)
+			}
+			key.private = private
+			key.public = private.Public().(ed25519.PublicKey)
+
+		case "PUBLIC KEY":
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("jwt: key %q: %w", id, err)
+			}
+
+			public, ok := parsed.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: key %q is not an Ed25519 public key", id)
+			}
+			key.public = public
+
+		default:
+			return nil, fmt.Errorf("jwt: key %q has unsupported PEM block type %q", id, block.Type)
+		}
+
+	default:
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q", algorithm)
+	}
+
+	return key, nil
+}
+
+// CanSign reports whether the key can sign tokens, rather than only verify them.
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+
+	return ed25519.Sign(k.private, input)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	return ed25519.Verify(k.public, input, signature)
+}
+
+// A KeySet holds the keys which tokens are verified with. The first key signs new tokens, and
+// its ID is put in their "kid" header so that the key can be found again when the token is
+// verified. Keys can be rotated by putting a new key first and keeping the old one in the set
+// for as long as the tokens which it signed remain valid.
+type KeySet struct {
+	signing *Key
+	ordered []*Key
+	keys    map[string]*Key
+}
+
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: at least one key must be provided")
+	}
+
+	if !keys[0].CanSign() {
+		return nil, fmt.Errorf("jwt: key %q can't sign tokens", keys[0].ID)
+	}
+
+	ks := &KeySet{
+		signing: keys[0],
+		keys:    make(map[string]*Key, len(keys)),
+	}
+
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key ID %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+		ks.ordered = append(ks.ordered, key)
+	}
+
+	return ks, nil
+}
+
+// Sign returns the signed token for the claims.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: ks.signing.Algorithm, Type: "JWT", KeyID: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	signature := ks.signing.sign([]byte(input))
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature, that it was issued by the issuer and that it is valid at
+// the given time, and returns its claims. The algorithm in the token's header must be the
+// algorithm of the key which it names, so a token can't pick a weaker way of being verified.
+func (ks *KeySet) Verify(token, issuer string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	err := decodeSegment(parts[0], &h)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, ok := ks.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	switch {
+	case claims.Issuer != issuer:
+		return nil, ErrInvalidToken
+	case claims.Expiry == 0 || claims.NotBefore > now.Unix():
+		return nil, ErrInvalidToken
+	case claims.Expiry <= now.Unix():
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, dst)
+}
+
+// A JWK is the public part of an EdDSA key in JSON Web Key (RFC 8037) form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWKS returns the public keys in the set, for publishing as a JSON Web Key Set. HS256 secrets
+// are never included, so the set is empty when only HS256 keys are used.
+func (ks *KeySet) JWKS() []JWK {
+	jwks := []JWK{}
+
+	for _, key := range ks.ordered {
+		if key.Algorithm != EdDSA {
+			continue
+		}
+
+		jwks = append(jwks, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.public),
+			KeyID:     key.ID,
+			Algorithm: EdDSA,
+			Use:       "sig",
+		})
+	}
+
+	return jwks
+}
@@ -0,0 +1,348 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const issuer = "greenlight"
+
+var now = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newHS256Key(t *testing.T, id string) *Key {
+	t.Helper()
+
+	key, err := NewKey(id, HS256, []byte(strings.Repeat(id, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newEdDSAKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewKey(id, EdDSA, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newKeySet(t *testing.T, keys ...*Key) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ks
+}
+
+func validClaims() Claims {
+	return Claims{
+		Issuer:      issuer,
+		Subject:     "42",
+		IssuedAt:    now.Unix(),
+		Expiry:      now.Add(15 * time.Minute).Unix(),
+		SessionID:   7,
+		Activated:   true,
+		Permissions: []string{"movies:read"},
+	}
+}
+
+func sign(t *testing.T, ks *KeySet, claims Claims) string {
+	t.Helper()
+
+	token, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// encode returns the base64url encoding of the JSON for v, as in a token's segments.
+func encode(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestSignVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		key  func(t *testing.T, id string) *Key
+	}{
+		{name: "HS256", key: newHS256Key},
+		{name: "EdDSA", key: newEdDSAKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := newKeySet(t, tt.key(t, "current"))
+			want := validClaims()
+
+			got, err := ks.Verify(sign(t, ks, want), issuer, now)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+
+			if got.Subject != want.Subject || got.SessionID != want.SessionID || got.Expiry != want.Expiry ||
+				got.Activated != want.Activated || strings.Join(got.Permissions, ",") != strings.Join(want.Permissions, ",") {
+				t.Errorf("Verify() = %+v; want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	old := newEdDSAKey(t, "old")
+	token := sign(t, newKeySet(t, old), validClaims())
+
+	ks := newKeySet(t, newEdDSAKey(t, "new"), old)
+
+	_, err := ks.Verify(token, issuer, now)
+	if err != nil {
+		t.Errorf("Verify() error = %v; want nil", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	hs256 := newHS256Key(t, "hs")
+	eddsa := newEdDSAKey(t, "ed")
+	ks := newKeySet(t, hs256, eddsa)
+
+	valid := sign(t, ks, validClaims())
+	parts := strings.Split(valid, ".")
+
+	expired := validClaims()
+	expired.IssuedAt = now.Add(-time.Hour).Unix()
+	expired.Expiry = now.Add(-time.Minute).Unix()
+
+	expiresNow := validClaims()
+	expiresNow.Expiry = now.Unix()
+
+	notYetValid := validClaims()
+	notYetValid.NotBefore = now.Add(time.Minute).Unix()
+
+	noExpiry := validClaims()
+	noExpiry.Expiry = 0
+
+	otherIssuer := validClaims()
+	otherIssuer.Issuer = "someone-else"
+
+	noIssuer := validClaims()
+	noIssuer.Issuer = ""
+
+	tampered := validClaims()
+	tampered.Subject = "1"
+	tampered.Permissions = []string{"movies:read", "movies:write", "users:admin"}
+
+	tamperedSignature := []byte(parts[2])
+	if tamperedSignature[0] == 'A' {
+		tamperedSignature[0] = 'B'
+	} else {
+		tamperedSignature[0] = 'A'
+	}
+
+	// Signed with the HS256 algorithm, but using the EdDSA key's public key as the secret, as
+	// an attacker who knows the public key could.
+	confused := encode(t, header{Algorithm: HS256, Type: "JWT", KeyID: "ed"}) + "." + encode(t, validClaims())
+	confusedKey := &Key{ID: "ed", Algorithm: HS256, secret: eddsa.public}
+	confused += "." + base64.RawURLEncoding.EncodeToString(confusedKey.sign([]byte(confused)))
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{
+			name:  "alg none",
+			token: encode(t, header{Algorithm: "none", Type: "JWT", KeyID: "hs"}) + "." + encode(t, validClaims()) + ".",
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "alg none without kid",
+			token: encode(t, map[string]string{"alg": "none"}) + "." + encode(t, validClaims()) + ".",
+			want:  ErrUnknownKey,
+		},
+		{
+			name:  "algorithm of another key",
+			token: encode(t, header{Algorithm: EdDSA, Type: "JWT", KeyID: "hs"}) + "." + parts[1] + "." + parts[2],
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "HS256 with a public key",
+			token: confused,
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "unknown kid",
+			token: encode(t, header{Algorithm: HS256, Type: "JWT", KeyID: "retired"}) + "." + parts[1] + "." + parts[2],
+			want:  ErrUnknownKey,
+		},
+		{
+			name:  "expired",
+			token: sign(t, ks, expired),
+			want:  ErrExpiredToken,
+		},
+		{
+			name:  "expires now",
+			token: sign(t, ks, expiresNow),
+			want:  ErrExpiredToken,
+		},
+		{
+			name:  "not valid yet",
+			token: sign(t, ks, notYetValid),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "no expiry",
+			token: sign(t, ks, noExpiry),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "other issuer",
+			token: sign(t, ks, otherIssuer),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "no issuer",
+			token: sign(t, ks, noIssuer),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "tampered payload",
+			token: parts[0] + "." + encode(t, tampered) + "." + parts[2],
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "tampered signature",
+			token: parts[0] + "." + parts[1] + "." + string(tamperedSignature),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "no signature",
+			token: parts[0] + "." + parts[1] + ".",
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "too few segments",
+			token: parts[0] + "." + parts[1],
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "malformed header",
+			token: "not-base64!." + parts[1] + "." + parts[2],
+			want:  ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ks.Verify(tt.token, issuer, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v; want %v", err, tt.want)
+			}
+			if claims != nil {
+				t.Errorf("Verify() claims = %+v; want nil", claims)
+			}
+		})
+	}
+}
+
+func TestNotBeforeReached(t *testing.T) {
+	ks := newKeySet(t, newHS256Key(t, "hs"))
+
+	claims := validClaims()
+	claims.NotBefore = now.Unix()
+
+	_, err := ks.Verify(sign(t, ks, claims), issuer, now)
+	if err != nil {
+		t.Errorf("Verify() error = %v; want nil", err)
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	eddsa := newEdDSAKey(t, "ed")
+
+	der, err := x509.MarshalPKIXPublicKey(eddsa.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := NewKey("public", EdDSA, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keys    []*Key
+		wantErr bool
+	}{
+		{name: "no keys", keys: nil, wantErr: true},
+		{name: "public key first", keys: []*Key{public}, wantErr: true},
+		{name: "duplicate IDs", keys: []*Key{eddsa, eddsa}, wantErr: true},
+		{name: "public key kept for verifying", keys: []*Key{newHS256Key(t, "hs"), public}, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeySet(tt.keys...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewKeySet() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        string
+		algorithm string
+		material  []byte
+	}{
+		{name: "no ID", id: "", algorithm: HS256, material: []byte(strings.Repeat("x", 32))},
+		{name: "short HS256 secret", id: "hs", algorithm: HS256, material: []byte(strings.Repeat("x", 31))},
+		{name: "EdDSA without PEM", id: "ed", algorithm: EdDSA, material: []byte("not pem")},
+		{name: "unsupported algorithm", id: "rs", algorithm: "RS256", material: []byte(strings.Repeat("x", 32))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKey(tt.id, tt.algorithm, tt.material)
+			if err == nil {
+				t.Errorf("NewKey() error = nil; want an error")
+			}
+		})
+	}
+}
@@ -5,28 +5,59 @@ import (
 	"embed"
 	"github.com/go-mail/mail/v2"
 	"html/template"
-	"time"
+	"io/fs"
+	"strings"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// A Message is an email rendered from one of the templates, ready to be sent.
+type Message struct {
+	To        string
+	From      string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	Template  string
+}
+
+// build returns the message as a MIME message, with plain text and HTML alternatives.
+func (msg *Message) build() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// A Sender delivers rendered messages. The transport is chosen when the application starts, so
+// that development and tests don't need a real SMTP server.
+type Sender interface {
+	Send(msg *Message) error
+}
+
+type Mailer struct {
+	transport Sender
+	sender    string
+}
 
+func New(transport Sender, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
 	}
 }
 
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// Send renders the template with the data and sends it to the recipient. If there is a version of
+// the template for the locale, such as user_welcome.pt-BR.tmpl for user_welcome.tmpl, it is
+// used instead, and otherwise the email is sent in English.
+func (m Mailer) Send(recipient, templateFile, locale string, data any) error {
+	templateFile = localizedTemplate(templateFile, locale)
+
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
 		return err
@@ -50,17 +81,31 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 		return err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg := &Message{
+		To:        recipient,
+		From:      m.sender,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		Template:  templateFile,
+	}
+
+	return m.transport.Send(msg)
+}
+
+// localizedTemplate returns the name of the template's version for the locale, if there is one,
+// or else the name of the template.
+func localizedTemplate(templateFile, locale string) string {
+	if locale == "" {
+		return templateFile
+	}
+
+	localized := strings.TrimSuffix(templateFile, ".tmpl") + "." + locale + ".tmpl"
 
-	err = m.dialer.DialAndSend(msg)
+	_, err := fs.Stat(templateFS, "templates/"+localized)
 	if err != nil {
-		return err
+		return templateFile
 	}
 
-	return nil
+	return localized
 }
@@ -0,0 +1,211 @@
+package mailer
+
+import (
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const (
+	sender          = "Greenlight <no-reply@greenlight.example.com>"
+	activationToken = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+)
+
+var tokenRX = regexp.MustCompile(`\{"token": "([A-Z2-7]{26})"\}`)
+
+func welcomeData() map[string]any {
+	return map[string]any{
+		"activationToken": activationToken,
+		"userID":          42,
+	}
+}
+
+func TestSendWithMemorySender(t *testing.T) {
+	tests := []struct {
+		name         string
+		locale       string
+		wantTemplate string
+		wantSubject  string
+	}{
+		{name: "english", locale: "en", wantTemplate: "user_welcome.tmpl", wantSubject: "Welcome to Greenlight!"},
+		{name: "translated", locale: "pt-BR", wantTemplate: "user_welcome.pt-BR.tmpl"},
+		{name: "unsupported locale", locale: "fr", wantTemplate: "user_welcome.tmpl", wantSubject: "Welcome to Greenlight!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewMemorySender()
+			m := New(transport, sender)
+
+			err := m.Send("alice@example.com", "user_welcome.tmpl", tt.locale, welcomeData())
+			if err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+
+			messages := transport.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("got %d messages; want 1", len(messages))
+			}
+
+			msg := messages[0]
+
+			if msg.To != "alice@example.com" || msg.From != sender || msg.Template != tt.wantTemplate {
+				t.Errorf("message = to %q, from %q, template %q", msg.To, msg.From, msg.Template)
+			}
+
+			if tt.wantSubject != "" && strings.TrimSpace(msg.Subject) != tt.wantSubject {
+				t.Errorf("subject = %q; want %q", msg.Subject, tt.wantSubject)
+			}
+
+			for body, text := range map[string]string{"plain": msg.PlainBody, "HTML": msg.HTMLBody} {
+				match := tokenRX.FindStringSubmatch(text)
+				if match == nil || match[1] != activationToken {
+					t.Errorf("%s body doesn't contain the activation token:\n%s", body, text)
+				}
+
+				if !strings.Contains(text, "42") {
+					t.Errorf("%s body doesn't contain the user ID", body)
+				}
+			}
+		})
+	}
+}
+
+func TestMemorySenderReset(t *testing.T) {
+	transport := NewMemorySender()
+	m := New(transport, sender)
+
+	for range 2 {
+		err := m.Send("alice@example.com", "user_welcome.tmpl", "en", welcomeData())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := transport.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages; want 2", len(messages))
+	}
+
+	// The messages returned are a copy, which later sends don't change.
+	messages[0].To = "changed@example.com"
+	if transport.Messages()[0].To != "alice@example.com" {
+		t.Error("Messages() returned the sender's own slice")
+	}
+
+	transport.Reset()
+	if got := len(transport.Messages()); got != 0 {
+		t.Errorf("got %d messages after Reset(); want 0", got)
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	transport := NewMemorySender()
+
+	err := New(transport, sender).Send("alice@example.com", "no_such_template.tmpl", "en", nil)
+	if err == nil {
+		t.Error("Send() error = nil; want an error")
+	}
+
+	if got := len(transport.Messages()); got != 0 {
+		t.Errorf("got %d messages; want 0", got)
+	}
+}
+
+func TestDirSender(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+
+	transport, err := NewDirSender(dir)
+	if err != nil {
+		t.Fatalf("NewDirSender() error = %v", err)
+	}
+
+	err = New(transport, sender).Send("alice@example.com", "user_welcome.tmpl", "es", welcomeData())
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d files; want 1", len(entries))
+	}
+
+	name := entries[0].Name()
+	if !strings.HasSuffix(name, "-user_welcome.es.tmpl.eml") {
+		t.Errorf("file name = %q; want it to end in -user_welcome.es.tmpl.eml", name)
+	}
+
+	eml, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"To: alice@example.com",
+		"From: " + sender,
+		"Subject: ",
+		"Content-Type: multipart/alternative",
+		"Content-Type: text/plain",
+		"Content-Type: text/html",
+		activationToken,
+	} {
+		if !strings.Contains(string(eml), want) {
+			t.Errorf("%s doesn't contain %q:\n%s", name, want, eml)
+		}
+	}
+}
+
+func TestLocalizedTemplate(t *testing.T) {
+	tests := []struct {
+		name         string
+		templateFile string
+		locale       string
+		want         string
+	}{
+		{name: "translated", templateFile: "user_welcome.tmpl", locale: "pt-BR", want: "user_welcome.pt-BR.tmpl"},
+		{name: "translated into es", templateFile: "token_activation.tmpl", locale: "es", want: "token_activation.es.tmpl"},
+		{name: "english", templateFile: "user_welcome.tmpl", locale: "en", want: "user_welcome.tmpl"},
+		{name: "no locale", templateFile: "user_welcome.tmpl", locale: "", want: "user_welcome.tmpl"},
+		{name: "not translated", templateFile: "user_lockout.tmpl", locale: "pt-BR", want: "user_lockout.tmpl"},
+		{name: "unsupported locale", templateFile: "user_welcome.tmpl", locale: "fr", want: "user_welcome.tmpl"},
+		{name: "locale case must match", templateFile: "user_welcome.tmpl", locale: "pt-br", want: "user_welcome.tmpl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := localizedTemplate(tt.templateFile, tt.locale); got != tt.want {
+				t.Errorf("localizedTemplate(%q, %q) = %q; want %q", tt.templateFile, tt.locale, got, tt.want)
+			}
+		})
+	}
+}
+
+// Every template, including the translated ones, must define the three parts of a message.
+func TestTemplatesDefineEveryPart(t *testing.T) {
+	files, err := fs.Glob(templateFS, "templates/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			tmpl, err := template.New("email").ParseFS(templateFS, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range []string{"subject", "plainBody", "htmlBody"} {
+				if tmpl.Lookup(name) == nil {
+					t.Errorf("%s doesn't define %q", file, name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// SMTPSender sends messages through an SMTP server.
+type SMTPSender struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPSender(host string, port int, username, password string) *SMTPSender {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPSender{dialer: dialer}
+}
+
+func (s *SMTPSender) Send(msg *Message) error {
+	return s.dialer.DialAndSend(msg.build())
+}
+
+// DirSender writes each message to a .eml file in a directory, where it can be opened with an
+// email client.
+type DirSender struct {
+	dir string
+}
+
+// NewDirSender returns a DirSender for the directory, creating it if it doesn't exist.
+func NewDirSender(dir string) (*DirSender, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirSender{dir: dir}, nil
+}
+
+func (s *DirSender) Send(msg *Message) error {
+	// The file names sort in the order the messages were sent.
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), filepath.Base(msg.Template))
+
+	f, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.build().WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LogSender writes messages to a logger instead of sending them.
+type LogSender struct {
+	logger *slog.Logger
+}
+
+func NewLogSender(logger *slog.Logger) *LogSender {
+	return &LogSender{logger: logger}
+}
+
+func (s *LogSender) Send(msg *Message) error {
+	s.logger.Info("email", "to", msg.To, "subject", msg.Subject, "template", msg.Template, "body", msg.PlainBody)
+	return nil
+}
+
+// MemorySender keeps the messages it is given, so that tests can check what would have been
+// sent, and read the tokens out of them.
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far, oldest first.
+func (s *MemorySender) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.messages...)
+}
+
+// Reset forgets the messages sent so far.
+func (s *MemorySender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = nil
+}
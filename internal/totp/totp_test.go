@@ -0,0 +1,162 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The secret of the RFC 6238 SHA-1 test vectors, "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC 6238 appendix B vectors are 8 digits long. Codes with 6 digits are the last 6 of
+	// them, as both are taken from the same value.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+			if err != nil {
+				t.Fatalf("Code() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Code() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	got, err := Code(strings.ToLower(rfcSecret), time.Unix(59, 0))
+	if err != nil {
+		t.Fatalf("Code() error = %v", err)
+	}
+	if got != "287082" {
+		t.Errorf("Code() = %q; want %q", got, "287082")
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	_, err := Code("not base32!", time.Unix(59, 0))
+	if err == nil {
+		t.Error("Code() error = nil; want an error")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Counter(now)
+
+	codeAt := func(steps int64) string {
+		code, err := codeForCounter(rfcSecret, current+steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name        string
+		code        string
+		skew        int
+		wantOK      bool
+		wantCounter int64
+	}{
+		{name: "current step", code: "050471", skew: 1, wantOK: true, wantCounter: current},
+		{name: "one step behind", code: codeAt(-1), skew: 1, wantOK: true, wantCounter: current - 1},
+		{name: "one step ahead", code: codeAt(1), skew: 1, wantOK: true, wantCounter: current + 1},
+		{name: "two steps behind", code: codeAt(-2), skew: 1, wantOK: false},
+		{name: "two steps ahead", code: codeAt(2), skew: 1, wantOK: false},
+		{name: "one step behind without skew", code: codeAt(-1), skew: 0, wantOK: false},
+		{name: "wrong code", code: "000000", skew: 1, wantOK: false},
+		{name: "too short", code: "50471", skew: 1, wantOK: false},
+		{name: "too long", code: "0050471", skew: 1, wantOK: false},
+		{name: "8 digit RFC code", code: "14050471", skew: 1, wantOK: false},
+		{name: "empty", code: "", skew: 1, wantOK: false},
+		{name: "not numeric", code: "abcdef", skew: 1, wantOK: false},
+		{name: "padded with spaces", code: " 50471", skew: 1, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := Verify(rfcSecret, tt.code, now, tt.skew)
+			if ok != tt.wantOK {
+				t.Fatalf("Verify() ok = %v; want %v", ok, tt.wantOK)
+			}
+			if counter != tt.wantCounter {
+				t.Errorf("Verify() counter = %d; want %d", counter, tt.wantCounter)
+			}
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want int64
+	}{
+		{unix: 0, want: 0},
+		{unix: 29, want: 0},
+		{unix: 30, want: 1},
+		{unix: 59, want: 1},
+		{unix: 1111111109, want: 37037036},
+		{unix: 1111111111, want: 37037037},
+	}
+
+	for _, tt := range tests {
+		if got := Counter(time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("Counter(%d) = %d; want %d", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("GenerateSecret() = %q, which isn't base32: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("GenerateSecret() is %d bytes long; want 20", len(key))
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Greenlight", "alice@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Greenlight:alice@example.com" {
+		t.Errorf("URI() = %q", u)
+	}
+
+	want := map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Greenlight",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for key, value := range want {
+		if got := u.Query().Get(key); got != value {
+			t.Errorf("URI() %s = %q; want %q", key, got, value)
+		}
+	}
+}
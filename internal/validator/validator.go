@@ -10,14 +10,22 @@ var (
 	EmailRX = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 )
 
+// A Message is a validation error. It is identified by a stable code rather than by its text, so
+// that it can be translated into the client's language when the response is sent. The args fill
+// in the placeholders of the translated text, such as a maximum length.
+type Message struct {
+	Code string
+	Args []any
+}
+
 // Define a new Validator type which contains a map of validation errors.
 type Validator struct {
-	Errors map[string]string
+	Errors map[string]Message
 }
 
 // New is a helper which creates a new Validator instance with an empty errors map.
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string]Message)}
 }
 
 func (v *Validator) Valid() bool {
@@ -25,16 +33,16 @@ func (v *Validator) Valid() bool {
 }
 
 // AddError adds an error message to the map (so long as no entry already exists for the key)
-func (v *Validator) AddError(key, message string) {
+func (v *Validator) AddError(key, code string, args ...any) {
 	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
+		v.Errors[key] = Message{Code: code, Args: args}
 	}
 }
 
 // Check adds an error message to the map only if a validation check is not ok.
-func (v *Validator) Check(ok bool, key, message string) {
+func (v *Validator) Check(ok bool, key, code string, args ...any) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddError(key, code, args...)
 	}
 }
 
@@ -0,0 +1,8 @@
+CREATE SEQUENCE IF NOT EXISTS tokens_family_id_seq;
+
+-- Every token belongs to a family. A family holds an authentication token and, optionally,
+-- the chain of refresh tokens which replaced it. Existing tokens each get a family of their own.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id bigint NOT NULL DEFAULT nextval('tokens_family_id_seq');
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS api_keys_permissions;
+DROP TABLE IF EXISTS api_keys;
+
+DROP INDEX IF EXISTS users_owner_id_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS owner_id;
+ALTER TABLE users DROP COLUMN IF EXISTS service_account;
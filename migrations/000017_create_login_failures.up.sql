@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone
+);
+
+INSERT INTO permissions (code)
+VALUES ('users:admin');
+
+-- Users who can already administer movies can also administer users, so that someone can lift
+-- a lockout.
+INSERT INTO user_permissions
+SELECT user_permissions.user_id, users_admin.id
+FROM user_permissions
+INNER JOIN permissions ON permissions.id = user_permissions.permission_id
+CROSS JOIN (SELECT id FROM permissions WHERE code = 'users:admin') AS users_admin
+WHERE permissions.code = 'movies:admin'
+ON CONFLICT DO NOTHING;
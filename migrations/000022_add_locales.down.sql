@@ -0,0 +1,2 @@
+ALTER TABLE outbox DROP COLUMN IF EXISTS locale;
+ALTER TABLE users DROP COLUMN IF EXISTS locale;